@@ -0,0 +1,475 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"math"
+	"sort"
+)
+
+// BucketStrategy is a strategy to split the values of a column
+// into ranges.
+type BucketStrategy string
+
+const (
+	// BucketDistinct splits the distinct values of a column into
+	// ranges with the same number of distinct values.
+	BucketDistinct BucketStrategy = "distinct"
+	// BucketEquiDepth splits the values of a column into ranges
+	// with about the same number of events.
+	BucketEquiDepth BucketStrategy = "equi-depth"
+)
+
+// HighCardinalityStrategy is a strategy to partition string columns
+// with too many distinct values for value ranges.
+type HighCardinalityStrategy string
+
+const (
+	// HighCardinalityHash splits the values into hash buckets.
+	HighCardinalityHash HighCardinalityStrategy = "hash"
+	// HighCardinalityPrefix splits the values into ranges of
+	// prefixes.
+	HighCardinalityPrefix HighCardinalityStrategy = "prefix"
+	// HighCardinalityNone doesn't partition the columns.
+	HighCardinalityNone HighCardinalityStrategy = "none"
+)
+
+// maxPrefixLength is the longest prefix used by prefix ranges.
+const maxPrefixLength = 16
+
+// autoBucketCounts are the bucket counts tried by Options.AutoBuckets.
+var autoBucketCounts = []int{2, 4, 8, 16, 32, 64}
+
+// bucketing describes how to split the values of columns into ranges.
+type bucketing struct {
+	strategy BucketStrategy
+	// buckets is the number of ranges for columns that aren't
+	// in columnBuckets.
+	buckets       int
+	columnBuckets map[string]int
+	// boundaries holds the values that range boundaries are aligned
+	// to, by column.
+	boundaries map[string][]boundary
+	// highCardinality holds the string columns that are split into
+	// hash or prefix ranges with highCardinalityStrategy.
+	highCardinality         map[string]bool
+	highCardinalityStrategy HighCardinalityStrategy
+	// timeBuckets holds the granularity of the numeric columns that
+	// are split into time ranges instead of value ranges.
+	timeBuckets map[string]TimeGranularity
+}
+
+// boundary is a value that range boundaries are aligned to. A range
+// starts at the value if before is set, and after the value if after
+// is set.
+type boundary struct {
+	value  interface{}
+	before bool
+	after  bool
+}
+
+// constraintBoundaries returns the boundaries that separate the
+// values meeting the constraints from the values that don't.
+func constraintBoundaries(constraints []ConstraintSet) map[string][]boundary {
+	boundaries := map[string][]boundary{}
+	var add func(c Constraint)
+	add = func(c Constraint) {
+		switch c.Operator {
+		case ConstraintOperatorOr:
+			for _, cons := range c.Any {
+				add(cons)
+			}
+		case ConstraintOperatorEquals, ConstraintOperatorNotEquals:
+			boundaries[c.Column] = append(boundaries[c.Column], boundary{value: c.Value, before: true, after: true})
+		case ConstraintOperatorIn:
+			for _, v := range c.values() {
+				boundaries[c.Column] = append(boundaries[c.Column], boundary{value: v, before: true, after: true})
+			}
+		case ConstraintOperatorLessThan, ConstraintOperatorGreaterThanOrEqual:
+			boundaries[c.Column] = append(boundaries[c.Column], boundary{value: c.Value, before: true})
+		case ConstraintOperatorLessThanOrEqual, ConstraintOperatorGreaterThan:
+			boundaries[c.Column] = append(boundaries[c.Column], boundary{value: c.Value, after: true})
+		}
+	}
+	for _, cs := range constraints {
+		for _, constraints := range cs {
+			for _, c := range constraints {
+				add(c)
+			}
+		}
+	}
+	return boundaries
+}
+
+// columnRanges returns the ranges for each column in cs. Columns
+// that some events don't have get a MissingColumnRange as well.
+// Columns with both numbers and strings get ranges for each type,
+// numbers first, and the buckets are shared by the weight of the
+// values of each type. Numbers of time columns get ranges of whole
+// time buckets instead.
+func (b bucketing) columnRanges(cs columnset, events []Event) map[string][]ColumnRange {
+	result := map[string][]ColumnRange{}
+	for _, column := range cs {
+		// Events without the column go into a missing range.
+		for _, e := range events {
+			if _, ok := e[column]; !ok {
+				result[column] = append(result[column], MissingColumnRange{})
+				break
+			}
+		}
+		n := b.buckets
+		if columnBuckets, ok := b.columnBuckets[column]; ok {
+			n = columnBuckets
+		}
+		if n < 1 {
+			n = 1
+		}
+
+		parts, counts := columnValues(column, events)
+		partWeights := make([][]float64, len(parts))
+		partTotals := make([]float64, len(parts))
+		total := 0.0
+		for i, vals := range parts {
+			partWeights[i] = make([]float64, vals.Len())
+			for j := range partWeights[i] {
+				partWeights[i][j] = 1
+				if b.strategy == BucketEquiDepth {
+					partWeights[i][j] = float64(counts[valueAt(vals, j)])
+				}
+				partTotals[i] += partWeights[i][j]
+			}
+			total += partTotals[i]
+		}
+
+		for i, vals := range parts {
+			partBuckets := n
+			if len(parts) > 1 {
+				partBuckets = int(float64(n)*partTotals[i]/total + 0.5)
+				if partBuckets < 1 {
+					partBuckets = 1
+				}
+			}
+			if granularity, ok := b.timeBuckets[column]; ok {
+				if _, isString := vals.(sort.StringSlice); !isString {
+					result[column] = append(result[column], b.timeRanges(vals, counts, granularity, partBuckets)...)
+					continue
+				}
+			}
+			if values, ok := vals.(sort.StringSlice); ok && b.highCardinality[column] {
+				switch b.highCardinalityStrategy {
+				case HighCardinalityHash:
+					for j := 0; j < partBuckets; j++ {
+						result[column] = append(result[column], HashColumnRange{Buckets: partBuckets, Min: j, Max: j})
+					}
+				case HighCardinalityPrefix:
+					result[column] = append(result[column], b.prefixRanges(values, counts, partBuckets)...)
+				}
+				continue
+			}
+
+			cuts := b.cuts(column, vals)
+			for _, group := range splitBuckets(partWeights[i], partBuckets, cuts, b.strategy == BucketEquiDepth) {
+				start, end := group[0], group[1]-1
+				switch vals := vals.(type) {
+				case sort.IntSlice:
+					result[column] = append(result[column], IntegerColumnRange{Min: vals[start], Max: vals[end]})
+				case sort.Float64Slice:
+					result[column] = append(result[column], FloatColumnRange{Min: vals[start], Max: vals[end]})
+				case sort.StringSlice:
+					result[column] = append(result[column], StringColumnRange{Min: vals[start], Max: vals[end]})
+				}
+			}
+		}
+	}
+	return result
+}
+
+// prefixRanges splits the sorted distinct values of a string column
+// into about n ranges of prefixes, given the number of events with
+// each value. It uses the shortest prefix length that has at least n
+// distinct prefixes.
+func (b bucketing) prefixRanges(values sort.StringSlice, counts map[interface{}]int, n int) []ColumnRange {
+	if len(values) == 0 {
+		return nil
+	}
+
+	var prefixes []string
+	var prefixCounts map[string]int
+	length := 1
+	for ; length <= maxPrefixLength; length++ {
+		prefixes = []string{}
+		prefixCounts = map[string]int{}
+		for _, v := range values {
+			p := prefix(v, length)
+			if prefixCounts[p] == 0 {
+				prefixes = append(prefixes, p)
+			}
+			prefixCounts[p] += counts[v]
+		}
+		if len(prefixes) >= n {
+			break
+		}
+	}
+	if length > maxPrefixLength {
+		length = maxPrefixLength
+	}
+
+	weights := make([]float64, len(prefixes))
+	for i, p := range prefixes {
+		weights[i] = 1
+		if b.strategy == BucketEquiDepth {
+			weights[i] = float64(prefixCounts[p])
+		}
+	}
+	ranges := []ColumnRange{}
+	for _, group := range splitBuckets(weights, n, nil, b.strategy == BucketEquiDepth) {
+		ranges = append(ranges, PrefixColumnRange{
+			Length: length,
+			Min:    prefixes[group[0]],
+			Max:    prefixes[group[1]-1],
+		})
+	}
+	return ranges
+}
+
+// timeRanges splits the sorted distinct numeric values of a time
+// column into at most n ranges of consecutive buckets of
+// granularity, given the number of events with each value. Only
+// buckets with values are counted, and each one is in a single
+// range.
+func (b bucketing) timeRanges(vals sort.Interface, counts map[interface{}]int, granularity TimeGranularity, n int) []ColumnRange {
+	starts := []int{}
+	weights := []float64{}
+	for i := 0; i < vals.Len(); i++ {
+		v := valueAt(vals, i)
+		var start int
+		switch v := v.(type) {
+		case int:
+			start = granularity.bucketStart(v)
+		case float64:
+			start = granularity.bucketStart(int(math.Floor(v)))
+		}
+		if len(starts) == 0 || starts[len(starts)-1] != start {
+			starts = append(starts, start)
+			weights = append(weights, 0)
+		}
+		if b.strategy == BucketEquiDepth {
+			weights[len(weights)-1] += float64(counts[v])
+		} else {
+			weights[len(weights)-1] = 1
+		}
+	}
+	if len(starts) == 0 {
+		return nil
+	}
+
+	d, _ := granularity.duration()
+	ranges := []ColumnRange{}
+	for _, group := range splitBuckets(weights, n, nil, b.strategy == BucketEquiDepth) {
+		ranges = append(ranges, TimeColumnRange{
+			Granularity: granularity,
+			Min:         starts[group[0]],
+			Max:         starts[group[1]-1] + d - 1,
+		})
+	}
+	return ranges
+}
+
+// cuts returns the indexes of the sorted values of column where a
+// range has to start.
+func (b bucketing) cuts(column string, vals sort.Interface) map[int]bool {
+	cuts := map[int]bool{}
+	for _, bound := range b.boundaries[column] {
+		// The first value that isn't before the boundary value, and
+		// the first value after it.
+		first := sort.Search(vals.Len(), func(i int) bool {
+			cmp, ok := compareValues(valueAt(vals, i), bound.value)
+			return ok && cmp >= 0
+		})
+		next := sort.Search(vals.Len(), func(i int) bool {
+			cmp, ok := compareValues(valueAt(vals, i), bound.value)
+			return ok && cmp > 0
+		})
+		if bound.before && first > 0 && first < vals.Len() {
+			cuts[first] = true
+		}
+		if bound.after && next > 0 && next < vals.Len() {
+			cuts[next] = true
+		}
+	}
+	return cuts
+}
+
+// columnValues returns the sorted distinct values of column, split
+// by type with numbers before strings, and the number of events with
+// each value. Ints are stored as floats if the column has any floats.
+func columnValues(column string, events []Event) ([]sort.Interface, map[interface{}]int) {
+	hasFloats := false
+	for _, e := range events {
+		if _, ok := e[column].(float64); ok {
+			// Columns with both ints and floats use
+			// float ranges.
+			hasFloats = true
+			break
+		}
+	}
+
+	ints := sort.IntSlice{}
+	floats := sort.Float64Slice{}
+	strs := sort.StringSlice{}
+	counts := map[interface{}]int{}
+	for _, e := range events {
+		switch v := e[column].(type) {
+		case int:
+			if hasFloats {
+				f := float64(v)
+				if counts[f] == 0 {
+					floats = append(floats, f)
+				}
+				counts[f]++
+				continue
+			}
+			if counts[v] == 0 {
+				ints = append(ints, v)
+			}
+			counts[v]++
+		case float64:
+			if counts[v] == 0 {
+				floats = append(floats, v)
+			}
+			counts[v]++
+		case string:
+			if counts[v] == 0 {
+				strs = append(strs, v)
+			}
+			counts[v]++
+		}
+	}
+
+	parts := []sort.Interface{}
+	for _, vals := range []sort.Interface{ints, floats, strs} {
+		if vals.Len() > 0 {
+			sort.Sort(vals)
+			parts = append(parts, vals)
+		}
+	}
+	return parts, counts
+}
+
+func valueAt(vals sort.Interface, i int) interface{} {
+	switch vals := vals.(type) {
+	case sort.IntSlice:
+		return vals[i]
+	case sort.Float64Slice:
+		return vals[i]
+	case sort.StringSlice:
+		return vals[i]
+	}
+	return nil
+}
+
+// splitBuckets splits values with the given weights into about n
+// groups of consecutive values, and returns the start and end index
+// of each group. Groups start at every cut. Each segment between
+// cuts gets a share of the groups by weight. If byWeight is set,
+// groups in a segment have about the same weight, otherwise the same
+// number of values.
+func splitBuckets(weights []float64, n int, cuts map[int]bool, byWeight bool) [][2]int {
+	segments := [][2]int{}
+	start := 0
+	for i := 1; i <= len(weights); i++ {
+		if i == len(weights) || cuts[i] {
+			segments = append(segments, [2]int{start, i})
+			start = i
+		}
+	}
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	groups := [][2]int{}
+	for _, segment := range segments {
+		segmentWeights := weights[segment[0]:segment[1]]
+		parts := n
+		if len(segments) > 1 {
+			segmentTotal := 0.0
+			for _, w := range segmentWeights {
+				segmentTotal += w
+			}
+			parts = int(float64(n)*segmentTotal/total + 0.5)
+		}
+		if parts < 1 {
+			parts = 1
+		}
+		if parts > len(segmentWeights) {
+			parts = len(segmentWeights)
+		}
+		var split [][2]int
+		if byWeight {
+			split = splitByWeight(segmentWeights, parts)
+		} else {
+			split = splitByCount(len(segmentWeights), parts)
+		}
+		for _, group := range split {
+			groups = append(groups, [2]int{segment[0] + group[0], segment[0] + group[1]})
+		}
+	}
+	return groups
+}
+
+// splitByCount splits l values into parts groups with the same
+// number of values. The last group gets the remainder.
+func splitByCount(l, parts int) [][2]int {
+	groups := [][2]int{}
+	size := l / parts
+	for i := 0; i < parts; i++ {
+		groups = append(groups, [2]int{i * size, (i + 1) * size})
+	}
+	groups[parts-1][1] = l
+	return groups
+}
+
+// splitByWeight splits values into parts groups with about the same
+// weight. Each group is at least one value.
+func splitByWeight(weights []float64, parts int) [][2]int {
+	remaining := 0.0
+	for _, w := range weights {
+		remaining += w
+	}
+	groups := [][2]int{}
+	start := 0
+	acc := 0.0
+	for i, w := range weights {
+		acc += w
+		left := parts - len(groups) - 1
+		if left == 0 {
+			break
+		}
+		// Cut when the group has its share of the remaining weight,
+		// or when the remaining values are needed for the remaining
+		// groups.
+		if acc >= remaining/float64(left+1) || len(weights)-(i+1) == left {
+			groups = append(groups, [2]int{start, i + 1})
+			start = i + 1
+			remaining -= acc
+			acc = 0
+		}
+	}
+	return append(groups, [2]int{start, len(weights)})
+}
@@ -0,0 +1,376 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitBuckets(t *testing.T) {
+	tests := []struct {
+		weights  []float64
+		n        int
+		cuts     map[int]bool
+		byWeight bool
+		expected [][2]int
+	}{
+		{[]float64{1, 1, 1, 1, 1}, 2, nil, false, [][2]int{{0, 2}, {2, 5}}},
+		{[]float64{1, 1}, 4, nil, false, [][2]int{{0, 1}, {1, 2}}},
+		{[]float64{100, 1, 1, 1, 1}, 2, nil, true, [][2]int{{0, 1}, {1, 5}}},
+		{[]float64{1, 1, 1, 100, 1}, 3, nil, true, [][2]int{{0, 3}, {3, 4}, {4, 5}}},
+		{[]float64{1, 1, 1, 1, 1, 1}, 1, map[int]bool{2: true, 3: true}, false, [][2]int{{0, 2}, {2, 3}, {3, 6}}},
+	}
+	for _, test := range tests {
+		got := splitBuckets(test.weights, test.n, test.cuts, test.byWeight)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("splitBuckets(%v, %d, %v, %v): expected %v, got %v",
+				test.weights, test.n, test.cuts, test.byWeight, test.expected, got)
+		}
+	}
+}
+
+func TestBucketing(t *testing.T) {
+	events := []Event{}
+	for i := 0; i < 100; i++ {
+		region := "us-west-1"
+		if i%10 == 0 {
+			region = string(rune('a' + i/10))
+		}
+		events = append(events, Event{"region": region, "n": i})
+	}
+
+	// Half the distinct regions are in each range, but most events
+	// are in the last one.
+	ranges := bucketing{strategy: BucketDistinct, buckets: 2}.columnRanges(columnset{"region"}, events)
+	if len(ranges["region"]) != 2 || ranges["region"][1].MaxValue() != "us-west-1" || ranges["region"][1].Single() {
+		t.Errorf("unexpected distinct ranges %v", ranges["region"])
+	}
+	ranges = bucketing{strategy: BucketEquiDepth, buckets: 2}.columnRanges(columnset{"region"}, events)
+	if len(ranges["region"]) != 2 || !ranges["region"][1].Single() {
+		t.Errorf("expected the most frequent region in its own range, got %v", ranges["region"])
+	}
+
+	b := bucketing{strategy: BucketDistinct, buckets: 16, columnBuckets: map[string]int{"n": 3}}
+	if ranges := b.columnRanges(columnset{"n"}, events); len(ranges["n"]) != 3 {
+		t.Errorf("expected 3 ranges, got %v", ranges["n"])
+	}
+
+	constraints := []ConstraintSet{
+		{"n": {{Column: "n", Operator: ConstraintOperatorLessThan, Value: 31.0}}},
+		{"n": {{Column: "n", Operator: ConstraintOperatorEquals, Value: 50}}},
+	}
+	b = bucketing{strategy: BucketDistinct, buckets: 4, boundaries: constraintBoundaries(constraints)}
+	ranges = b.columnRanges(columnset{"n"}, events)
+	for _, cs := range constraints {
+		for _, r := range ranges["n"] {
+			if cs["n"][0].matchRange(r) == matchSome {
+				t.Errorf("range %v isn't aligned to %v", r, cs["n"][0])
+			}
+		}
+	}
+}
+
+func TestGenerateBuckets(t *testing.T) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	constraints := []ConstraintSet{
+		{"usage_user": {{Column: "usage_user", Operator: ConstraintOperatorGreaterThan, Value: 50.0}}},
+	}
+	for _, opts := range []Options{
+		{Bucketing: BucketEquiDepth, Buckets: 4},
+		{AlignBuckets: true, ColumnBuckets: map[string]int{"usage_user": 1}},
+		{AutoBuckets: true},
+	} {
+		opts.Seed = 1
+		level, err := Generate(nil, events, constraints, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if equal, _ := compareEvents(events, level.RawEvents()); !equal {
+			t.Errorf("%+v: events are not equal", opts)
+		}
+		if opts.AlignBuckets {
+			for _, sublevel := range level.Sublevels {
+				if sublevel.Column == "usage_user" && constraints[0]["usage_user"][0].matchRange(sublevel.InternalRange) == matchSome {
+					t.Errorf("range %v isn't aligned", sublevel.InternalRange)
+				}
+			}
+		}
+	}
+
+	_, err = Generate(nil, events, constraints, Options{Bucketing: "random"})
+	if err == nil {
+		t.Error("expected an error for an unknown bucketing strategy")
+	}
+}
+
+func TestHighCardinalityColumns(t *testing.T) {
+	events := []Event{}
+	for i := 0; i < 3000; i++ {
+		events = append(events, Event{
+			"hostname": fmt.Sprintf("host_%04d", i),
+			"region":   fmt.Sprintf("region_%d", i%3),
+			"n":        i % 7,
+		})
+	}
+	columnSet, highCardinality := getColumnSets(events)
+	if columnSet.contains("hostname") || !highCardinality.contains("hostname") {
+		t.Fatalf("expected hostname to be a high cardinality column, got %v and %v", columnSet, highCardinality)
+	}
+
+	cs := ConstraintSet{"hostname": {{Column: "hostname", Operator: ConstraintOperatorEquals, Value: "host_0042"}}}
+	for _, strategy := range []HighCardinalityStrategy{HighCardinalityHash, HighCardinalityPrefix} {
+		level, err := Generate(nil, events, []ConstraintSet{cs}, Options{Seed: 1, HighCardinality: strategy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level.SublevelColumn != "hostname" {
+			t.Errorf("%s: expected level to be partitioned by hostname, got %q", strategy, level.SublevelColumn)
+		}
+
+		for _, format := range []string{FormatJSON, FormatBinary} {
+			buf := &bytes.Buffer{}
+			err = Encode(buf, level, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := Decode(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.String() != level.String() {
+				t.Errorf("%s: expected decoded %s level to match", strategy, format)
+			}
+
+			cur, err := decoded.Prune(cs).NewCursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, found := 0, false
+			for cur.Next() {
+				rows++
+				if hostname, _ := cur.Row().Get("hostname"); hostname == "host_0042" {
+					found = true
+				}
+			}
+			if !found || rows >= len(events)/2 {
+				t.Errorf("%s: expected pruning to keep host_0042 and skip most events, got %d rows", strategy, rows)
+			}
+		}
+	}
+
+	level, err := Generate(nil, events, []ConstraintSet{cs}, Options{Seed: 1, HighCardinality: HighCardinalityNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level.SublevelColumn == "hostname" {
+		t.Error("expected hostname not to be partitioned")
+	}
+}
+
+func TestMixedTypeColumns(t *testing.T) {
+	events := []Event{}
+	for i := 0; i < 200; i++ {
+		var status interface{} = 200 + i%5
+		if i%3 == 0 {
+			status = fmt.Sprintf("err_%d", i%4)
+		}
+		events = append(events, Event{"status": status, "n": i})
+	}
+	if cs := getColumnSet(events); !cs.contains("status") {
+		t.Fatalf("expected status to be a candidate column, got %v", cs)
+	}
+
+	columnRanges := getColumnRangesForColumnSet(columnset{"status"}, 4, events)
+	ranges := columnRanges["status"]
+	if len(ranges) < 2 {
+		t.Fatalf("expected ranges for both types, got %v", ranges)
+	}
+	if _, ok := ranges[0].(IntegerColumnRange); !ok {
+		t.Errorf("expected numbers first, got %v", ranges[0])
+	}
+	if _, ok := ranges[len(ranges)-1].(StringColumnRange); !ok {
+		t.Errorf("expected strings last, got %v", ranges[len(ranges)-1])
+	}
+
+	level := partitionEvents(events, columnRanges, "status")
+	if equal, _ := compareEvents(events, level.RawEvents()); !equal {
+		t.Error("events are not equal")
+	}
+
+	tests := []struct {
+		query string
+		match func(v interface{}) bool
+	}{
+		{`SELECT * WHERE status = 202`, func(v interface{}) bool { return v == 202 }},
+		{`SELECT * WHERE status = "err_1"`, func(v interface{}) bool { return v == "err_1" }},
+		{`SELECT * WHERE status < "err_2"`, func(v interface{}) bool {
+			s, ok := v.(string)
+			return !ok || s < "err_2"
+		}},
+		{`SELECT * WHERE status > 201`, func(v interface{}) bool {
+			n, ok := v.(int)
+			return !ok || n > 201
+		}},
+	}
+	for _, test := range tests {
+		expected := 0
+		for _, e := range events {
+			if test.match(e["status"]) {
+				expected++
+			}
+		}
+		rows := executeQuery(t, level, test.query)
+		for _, row := range rows {
+			if v, _ := row.Get("status"); !test.match(v) {
+				t.Errorf("%s: unexpected status %v", test.query, v)
+			}
+		}
+		if len(rows) != expected {
+			t.Errorf("%s: expected %d rows, got %d", test.query, expected, len(rows))
+		}
+	}
+}
+
+func TestTimeBuckets(t *testing.T) {
+	const start = 1451606400000000000 // 2016-01-01T00:00Z
+	events := []Event{}
+	for i := 0; i < 180; i++ {
+		events = append(events, Event{"_ts": start + i*int(time.Minute), "n": i % 5})
+	}
+
+	file := ConstraintsFile{}
+	err := json.Unmarshal([]byte(`{
+		"time_buckets": {"_ts": "hour"},
+		"constraints": [{"_ts": [
+			{"column": "_ts", "operator": ">=", "value": 1451610030000000000},
+			{"column": "_ts", "operator": "<", "value": 1451613570000000000}
+		]}]
+	}`), &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.TimeBuckets["_ts"] != TimeHour || len(file.Workload) != 1 {
+		t.Fatalf("unexpected constraints file %v", toJSON(file))
+	}
+	constraints, weights := file.Workload.ConstraintSets()
+	cs := constraints[0]
+
+	b := bucketing{strategy: BucketDistinct, buckets: 16, timeBuckets: file.TimeBuckets}
+	columnRanges := b.columnRanges(columnset{"_ts"}, events)
+	if len(columnRanges["_ts"]) != 3 {
+		t.Fatalf("expected a range for each hour, got %v", columnRanges["_ts"])
+	}
+	if s := fmt.Sprint(columnRanges["_ts"][1]); s != "hour[2016-01-01T01:00Z, 2016-01-01T02:00Z)" {
+		t.Errorf("unexpected range label %s", s)
+	}
+	level := partitionEvents(events, columnRanges, "_ts")
+
+	for _, format := range []string{FormatJSON, FormatBinary} {
+		buf := &bytes.Buffer{}
+		err = Encode(buf, level, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.String() != level.String() {
+			t.Errorf("%s: expected decoded level\n%v\nto match\n%v", format, decoded, level)
+		}
+		if equal, _ := compareEvents(events, decoded.RawEvents()); !equal {
+			t.Errorf("%s: events are not equal", format)
+		}
+
+		// The query window is inside the second hour, so only
+		// its bucket is read.
+		n := 0
+		for _, sublevel := range decoded.Sublevels {
+			if cs.CheckLevel(sublevel) {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("%s: expected 1 bucket to match, got %d", format, n)
+		}
+	}
+
+	level, err = Generate(nil, events, constraints, Options{Seed: 1, Weights: weights, TimeBuckets: file.TimeBuckets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal, _ := compareEvents(events, level.RawEvents()); !equal {
+		t.Error("events are not equal")
+	}
+	_, err = Generate(nil, events, constraints, Options{TimeBuckets: map[string]TimeGranularity{"_ts": "week"}})
+	if err == nil {
+		t.Error("expected an error for an unknown time granularity")
+	}
+}
+
+func TestTimeBucketLimit(t *testing.T) {
+	const start = 1451606400000000000 // 2016-01-01T00:00Z
+	events := []Event{}
+	for i := 0; i < 20000; i++ {
+		events = append(events, Event{"_ts": start + i*int(time.Minute)})
+	}
+
+	b := bucketing{strategy: BucketDistinct, buckets: 16, timeBuckets: map[string]TimeGranularity{"_ts": TimeMinute}}
+	columnRanges := b.columnRanges(columnset{"_ts"}, events)
+	ranges := columnRanges["_ts"]
+	if len(ranges) != 16 {
+		t.Fatalf("expected 16 ranges, got %d", len(ranges))
+	}
+	for i, r := range ranges {
+		r := r.(TimeColumnRange)
+		if i > 0 && r.Min != ranges[i-1].(TimeColumnRange).Max+1 {
+			t.Errorf("expected %v to start where %v ends", r, ranges[i-1])
+		}
+		if r.Min != TimeMinute.bucketStart(r.Min) {
+			t.Errorf("expected %v to start at a minute", r)
+		}
+	}
+
+	// Sublevels are only created for ranges with events.
+	level := &Level{}
+	for _, e := range events[:60] {
+		level.Push(e, []string{"_ts"}, columnRanges)
+	}
+	if len(level.Sublevels) != 1 {
+		t.Errorf("expected 1 sublevel, got %d", len(level.Sublevels))
+	}
+	for _, e := range events[60:] {
+		level.Push(e, []string{"_ts"}, columnRanges)
+	}
+	if len(level.Sublevels) != len(ranges) {
+		t.Fatalf("expected %d sublevels, got %d", len(ranges), len(level.Sublevels))
+	}
+	for i, sublevel := range level.Sublevels {
+		if sublevel.InternalRange != ranges[i] {
+			t.Errorf("expected sublevel %d to have range %v, got %v", i, ranges[i], sublevel.InternalRange)
+		}
+	}
+}
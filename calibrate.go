@@ -0,0 +1,164 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// calibrationRounds is the number of times each scan is timed.
+	// The fastest run is used.
+	calibrationRounds = 5
+	// calibrationLayouts is the maximum number of layouts built.
+	calibrationLayouts = 8
+)
+
+var errCalibration = errors.New("terrace: not enough variation in the scans to calibrate costs")
+
+// calibrationSample is a timed scan of a layout.
+type calibrationSample struct {
+	levels   float64
+	events   float64
+	duration float64
+}
+
+// Calibrate returns an AccessCostModel with level and event costs in
+// nanoseconds measured on this machine. It builds several layouts of
+// the events, times pruned scans of each layout for the constraint
+// sets, and fits the costs to the timings with least squares. If
+// there are no constraint sets, equality constraints are derived
+// from the events.
+func Calibrate(logger *log.Logger, events []Event, constraints []ConstraintSet) (AccessCostModel, error) {
+	columnSet := getColumnSet(events)
+	if len(constraints) == 0 {
+		constraints = calibrationConstraints(events, columnSet)
+	}
+
+	samples := []calibrationSample{}
+	for _, columnOrder := range calibrationOrders(columnSet) {
+		columnRanges := getColumnRangesForColumnSet(columnOrder, 16, events)
+		level := &Level{}
+		for _, e := range events {
+			level.Push(e, columnOrder, columnRanges)
+		}
+		level.Trim()
+
+		for _, cs := range constraints {
+			sample := calibrationSample{
+				levels:   AccessCostModel{LevelCost: 1}.Cost(level, cs, 1),
+				events:   AccessCostModel{EventCost: 1}.Cost(level, cs, 1),
+				duration: math.Inf(1),
+			}
+			for i := 0; i < calibrationRounds; i++ {
+				d, err := timeScan(level, cs)
+				if err != nil {
+					return AccessCostModel{}, err
+				}
+				sample.duration = math.Min(sample.duration, d)
+			}
+			if logger != nil {
+				logger.Printf("Calibration: %v levels, %v events in %v ns for column order %v",
+					sample.levels, sample.events, sample.duration, columnOrder)
+			}
+			samples = append(samples, sample)
+		}
+	}
+	return fitCosts(samples)
+}
+
+// calibrationOrders returns the column orders of the layouts built
+// by Calibrate, including an unpartitioned layout.
+func calibrationOrders(columnSet columnset) []columnset {
+	orders := []columnset{{}}
+	for _, column := range columnSet {
+		orders = append(orders, columnset{column})
+	}
+	for i := 1; i < len(columnSet); i++ {
+		orders = append(orders, columnset{columnSet[i-1], columnSet[i]})
+	}
+	if len(orders) > calibrationLayouts {
+		orders = orders[:calibrationLayouts]
+	}
+	return orders
+}
+
+// calibrationConstraints returns equality constraints on values of
+// the first, middle and last events for each column.
+func calibrationConstraints(events []Event, columnSet columnset) []ConstraintSet {
+	constraints := []ConstraintSet{}
+	if len(events) == 0 {
+		return constraints
+	}
+	for _, column := range columnSet {
+		for _, e := range []Event{events[0], events[len(events)/2], events[len(events)-1]} {
+			constraints = append(constraints, ConstraintSet{
+				column: {{Column: column, Operator: ConstraintOperatorEquals, Value: e[column]}},
+			})
+		}
+	}
+	return constraints
+}
+
+// timeScan returns the time in nanoseconds to read every event of
+// level that is left after pruning with cs.
+func timeScan(level *Level, cs ConstraintSet) (float64, error) {
+	start := time.Now()
+	cur, err := level.Prune(cs).NewCursor()
+	if err != nil {
+		return 0, err
+	}
+	for cur.Next() {
+	}
+	if err = cur.Err(); err != nil {
+		return 0, err
+	}
+	return float64(time.Since(start).Nanoseconds()), nil
+}
+
+// fitCosts fits the level and event costs to the samples with
+// non-negative least squares.
+func fitCosts(samples []calibrationSample) (AccessCostModel, error) {
+	var ll, le, ee, lt, et float64
+	for _, s := range samples {
+		ll += s.levels * s.levels
+		le += s.levels * s.events
+		ee += s.events * s.events
+		lt += s.levels * s.duration
+		et += s.events * s.duration
+	}
+	det := ll*ee - le*le
+	if ll == 0 || ee == 0 || det <= 1e-9*ll*ee {
+		return AccessCostModel{}, errCalibration
+	}
+	m := AccessCostModel{
+		LevelCost: (lt*ee - et*le) / det,
+		EventCost: (et*ll - lt*le) / det,
+	}
+	// Costs can't be negative, so fit the other cost alone.
+	if m.LevelCost < 0 {
+		m = AccessCostModel{EventCost: et / ee}
+	}
+	if m.EventCost < 0 {
+		m = AccessCostModel{LevelCost: lt / ll}
+	}
+	return m, nil
+}
@@ -0,0 +1,65 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import "testing"
+
+func TestFitCosts(t *testing.T) {
+	samples := []calibrationSample{}
+	for _, s := range [][2]float64{{1, 10}, {4, 2}, {8, 30}, {2, 0}} {
+		samples = append(samples, calibrationSample{
+			levels:   s[0],
+			events:   s[1],
+			duration: 15*s[0] + 250*s[1],
+		})
+	}
+	m, err := fitCosts(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if abs(m.LevelCost-15) > 1e-6 || abs(m.EventCost-250) > 1e-6 {
+		t.Errorf("expected costs 15 and 250, got %+v", m)
+	}
+
+	// Every scan reads levels and events in the same ratio.
+	_, err = fitCosts([]calibrationSample{{levels: 1, events: 2, duration: 5}, {levels: 2, events: 4, duration: 9}})
+	if err == nil {
+		t.Error("expected an error without enough variation")
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Calibrate(nil, events, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.LevelCost < 0 || m.EventCost < 0 || m.LevelCost+m.EventCost == 0 {
+		t.Errorf("unexpected costs %+v", m)
+	}
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,91 @@
+package cmd
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/Preetam/terrace"
+	"github.com/spf13/cobra"
+)
+
+type calibrateCommand struct {
+	cobraCommand *cobra.Command
+
+	// Args
+	inFile  string
+	outFile string
+	// Flags
+	constraintsFile string
+}
+
+func (cmd *calibrateCommand) Run() {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	logger.Println("Running calibrate")
+
+	events := readEvents(logger, cmd.inFile)
+	logger.Println("Read", len(events), "events")
+
+	var constraints []terrace.ConstraintSet
+	if cmd.constraintsFile != "" {
+		constraints, _ = readConstraintsFile(logger, cmd.constraintsFile).Workload.ConstraintSets()
+	}
+
+	model, err := terrace.Calibrate(logger, events, constraints)
+	if err != nil {
+		logger.Fatalf("error calibrating costs: %v", err)
+	}
+	logger.Printf("Level cost %g ns, event cost %g ns", model.LevelCost, model.EventCost)
+
+	marshaled, err := json.Marshal(model)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	marshaled = append(marshaled, '\n')
+	if cmd.outFile == "-" {
+		// stdout
+		_, err = os.Stdout.Write(marshaled)
+	} else {
+		err = ioutil.WriteFile(cmd.outFile, marshaled, 0644)
+	}
+	if err != nil {
+		logger.Fatalf("error writing cost file: %v", err)
+	}
+}
+
+func init() {
+	calibrateCmd := &calibrateCommand{
+		cobraCommand: &cobra.Command{
+			Use:   "calibrate <input file> <output file>",
+			Short: "Measure level and event costs for generate --cost-file",
+			Args:  cobra.MinimumNArgs(2),
+		},
+	}
+	calibrateCmd.cobraCommand.Run = func(cmd *cobra.Command, args []string) {
+		calibrateCmd.inFile = args[0]
+		calibrateCmd.outFile = args[1]
+		calibrateCmd.Run()
+	}
+	rootCmd.AddCommand(calibrateCmd.cobraCommand)
+
+	calibrateCmd.cobraCommand.
+		Flags().StringVar(&calibrateCmd.constraintsFile, "constraints", "", "Constraints file with the scans to time")
+}
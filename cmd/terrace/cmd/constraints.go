@@ -0,0 +1,121 @@
+package cmd
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Preetam/query"
+
+	"github.com/Preetam/terrace"
+	"github.com/spf13/cobra"
+)
+
+type constraintsCommand struct {
+	cobraCommand *cobra.Command
+
+	// Args
+	queryFile string
+	outFile   string
+}
+
+func (cmd *constraintsCommand) Run() {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	logger.Println("Running constraints")
+
+	var in io.Reader
+	if cmd.queryFile == "-" {
+		logger.Println("Using stdin")
+		// stdin
+		in = os.Stdin
+	} else {
+		queryFile, err := os.Open(cmd.queryFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer queryFile.Close()
+		in = queryFile
+	}
+
+	queries := []*query.Query{}
+	scanner := bufio.NewScanner(in)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parsedQuery, err := query.Parse(line)
+		if err != nil {
+			logger.Fatalf("error parsing query on line %d: %v", lineNum, err)
+		}
+		queries = append(queries, parsedQuery)
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Println("Read", len(queries), "queries")
+
+	workload := terrace.WorkloadConstraints(queries)
+	logger.Println("Generated", len(workload), "constraint sets")
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	// Keep operators like ">" readable.
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(workload)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if cmd.outFile == "-" {
+		// stdout
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = ioutil.WriteFile(cmd.outFile, buf.Bytes(), 0644)
+	}
+	if err != nil {
+		logger.Fatalf("error writing constraints file: %v", err)
+	}
+}
+
+func init() {
+	constraintsCmd := &constraintsCommand{
+		cobraCommand: &cobra.Command{
+			Use:   "constraints <query file> <output file>",
+			Short: "Generate a constraints file from a query log",
+			Long: "Generate a constraints file from a query log with one query per line.\n" +
+				"Constraint sets are weighted by how often they appear.",
+			Args: cobra.MinimumNArgs(2),
+		},
+	}
+	constraintsCmd.cobraCommand.Run = func(cmd *cobra.Command, args []string) {
+		constraintsCmd.queryFile = args[0]
+		constraintsCmd.outFile = args[1]
+		constraintsCmd.Run()
+	}
+	rootCmd.AddCommand(constraintsCmd.cobraCommand)
+}
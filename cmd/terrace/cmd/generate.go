@@ -20,7 +20,6 @@ package cmd
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -37,8 +36,24 @@ type generateCommand struct {
 	outFile string
 	// Flags
 	constraintsFile string
+	costFile        string
 	format          string
 	fast            bool
+	search          string
+	beamWidth       int
+	parallelism     int
+	seed            int64
+	buckets         int
+	columnBuckets   map[string]int
+	bucketing       string
+	alignBuckets    bool
+	autoBuckets     bool
+	highCardinality string
+	timeBuckets     map[string]string
+	cost            string
+	levelCost       float64
+	eventCost       float64
+	sizeWeight      float64
 	sizeCost        bool
 	verbose         bool
 }
@@ -47,55 +62,70 @@ func (cmd *generateCommand) Run() {
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 	logger.Println("Running generate")
 
-	var eventsFile []byte
-	var err error
-
-	if cmd.inFile == "-" {
-		logger.Println("Using stdin")
-		// stdin
-		eventsFile, err = ioutil.ReadAll(os.Stdin)
-	} else {
-		eventsFile, err = ioutil.ReadFile(cmd.inFile)
+	if cmd.format != terrace.FormatJSON && cmd.format != terrace.FormatBinary {
+		logger.Fatalf("unknown format %q", cmd.format)
 	}
-	if err != nil {
-		logger.Fatal(err)
+	if cmd.sizeCost {
+		cmd.cost = "size"
 	}
 
-	constraints := []terrace.ConstraintSet{}
+	events := readEvents(logger, cmd.inFile)
+	logger.Println("Read", len(events), "events")
+
+	file := terrace.ConstraintsFile{}
 	if cmd.constraintsFile != "" {
-		constraintsFile, err := os.Open(cmd.constraintsFile)
-		if err != nil {
-			logger.Fatal(err)
-		}
-		err = json.NewDecoder(constraintsFile).Decode(&constraints)
-		if err != nil {
-			logger.Fatalf("error reading constraints file: %v", err)
-		}
+		file = readConstraintsFile(logger, cmd.constraintsFile)
 	} else {
 		logger.Println("Missing constraints file. Using size-based cost evaluation.")
-		cmd.sizeCost = true
+		cmd.cost = "size"
 	}
 
-	events := []terrace.Event{}
-	for _, eventBytes := range bytes.Split(eventsFile, []byte("\n")) {
-		e := terrace.Event{}
-		if len(eventBytes) == 0 {
-			continue
-		}
-		err = json.Unmarshal(bytes.TrimSpace(eventBytes), &e)
+	access := terrace.AccessCostModel{LevelCost: cmd.levelCost, EventCost: cmd.eventCost}
+	if cmd.costFile != "" {
+		costFile, err := ioutil.ReadFile(cmd.costFile)
 		if err != nil {
 			logger.Fatal(err)
 		}
-		events = append(events, e)
+		err = json.Unmarshal(costFile, &access)
+		if err != nil {
+			logger.Fatalf("error reading cost file: %v", err)
+		}
+		logger.Printf("Using level cost %g and event cost %g", access.LevelCost, access.EventCost)
 	}
-	logger.Println("Read", len(events), "events")
 
+	timeBuckets := map[string]terrace.TimeGranularity{}
+	for column, granularity := range file.TimeBuckets {
+		timeBuckets[column] = granularity
+	}
+	for column, granularity := range cmd.timeBuckets {
+		timeBuckets[column] = terrace.TimeGranularity(granularity)
+	}
+
+	constraints, weights := file.Workload.ConstraintSets()
 	opts := terrace.Options{
-		Fast:     cmd.fast,
-		CostType: terrace.CostTypeAccess,
+		Fast:            cmd.fast,
+		Weights:         weights,
+		Search:          terrace.SearchStrategy(cmd.search),
+		BeamWidth:       cmd.beamWidth,
+		Parallelism:     cmd.parallelism,
+		Seed:            cmd.seed,
+		Buckets:         cmd.buckets,
+		ColumnBuckets:   cmd.columnBuckets,
+		Bucketing:       terrace.BucketStrategy(cmd.bucketing),
+		AlignBuckets:    cmd.alignBuckets,
+		AutoBuckets:     cmd.autoBuckets,
+		HighCardinality: terrace.HighCardinalityStrategy(cmd.highCardinality),
+		TimeBuckets:     timeBuckets,
 	}
-	if cmd.sizeCost {
-		opts.CostType = terrace.CostTypeSize
+	switch cmd.cost {
+	case "access":
+		opts.CostModel = access
+	case "size":
+		opts.CostModel = terrace.SizeCostModel{}
+	case "blended":
+		opts.CostModel = terrace.BlendedCostModel{Access: access, SizeWeight: cmd.sizeWeight}
+	default:
+		logger.Fatalf("unknown cost model %q", cmd.cost)
 	}
 	level, err := terrace.Generate(logger, events, constraints, opts)
 	if err != nil {
@@ -104,18 +134,21 @@ func (cmd *generateCommand) Run() {
 
 	if cmd.outFile == "-" {
 		// stdout
-		jsonLevel, err := json.Marshal(level)
+		err = terrace.Encode(os.Stdout, level, cmd.format)
 		if err != nil {
 			logger.Fatalf("error encoding Terrace file: %v", err)
 		}
-		fmt.Println(string(jsonLevel))
 	} else {
 		outFile, err := os.OpenFile(cmd.outFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			logger.Fatal(err)
 		}
 
-		err = json.NewEncoder(outFile).Encode(level)
+		err = terrace.Encode(outFile, level, cmd.format)
+		if err != nil {
+			logger.Fatalf("error writing Terrace file: %v", err)
+		}
+		err = outFile.Close()
 		if err != nil {
 			logger.Fatalf("error writing Terrace file: %v", err)
 		}
@@ -141,11 +174,92 @@ func init() {
 	generateCmd.cobraCommand.
 		Flags().StringVar(&generateCmd.constraintsFile, "constraints", "", "Constraints file")
 	generateCmd.cobraCommand.
-		Flags().StringVar(&generateCmd.format, "format", "json", "Output file format")
+		Flags().StringVar(&generateCmd.format, "format", terrace.FormatJSON, "Output file format (json or binary)")
 	generateCmd.cobraCommand.
 		Flags().BoolVar(&generateCmd.fast, "fast", true, "Fast generation")
+	generateCmd.cobraCommand.
+		Flags().StringVar(&generateCmd.search, "search", string(terrace.SearchBeam), "Column order search strategy (beam or sample)")
+	generateCmd.cobraCommand.
+		Flags().IntVar(&generateCmd.beamWidth, "beam-width", 0, "Column orders kept at each step of the beam search (default 4, or 1 with --fast)")
+	generateCmd.cobraCommand.
+		Flags().IntVar(&generateCmd.parallelism, "parallelism", 0, "Column orders evaluated at the same time (default GOMAXPROCS)")
+	generateCmd.cobraCommand.
+		Flags().Int64Var(&generateCmd.seed, "seed", 0, "Random seed for reproducible output (default random)")
+	generateCmd.cobraCommand.
+		Flags().IntVar(&generateCmd.buckets, "buckets", 16, "Number of ranges for each column")
+	generateCmd.cobraCommand.
+		Flags().StringToIntVar(&generateCmd.columnBuckets, "column-buckets", nil, "Number of ranges for some columns (column=count,...)")
+	generateCmd.cobraCommand.
+		Flags().StringVar(&generateCmd.bucketing, "bucketing", string(terrace.BucketDistinct), "Range bucketing strategy (distinct or equi-depth)")
+	generateCmd.cobraCommand.
+		Flags().BoolVar(&generateCmd.alignBuckets, "align-buckets", false, "Align range boundaries to constraint values")
+	generateCmd.cobraCommand.
+		Flags().BoolVar(&generateCmd.autoBuckets, "auto-buckets", false, "Pick the number of ranges for each constrained column by cost")
+	generateCmd.cobraCommand.
+		Flags().StringVar(&generateCmd.highCardinality, "high-cardinality", string(terrace.HighCardinalityHash), "Partitioning for high cardinality string columns (hash, prefix or none)")
+	generateCmd.cobraCommand.
+		Flags().StringToStringVar(&generateCmd.timeBuckets, "time-buckets", nil, "Time bucket granularity for timestamp columns, like _ts=hour (minute, hour or day)")
+	generateCmd.cobraCommand.
+		Flags().StringVar(&generateCmd.cost, "cost", "access", "Cost model (access, size or blended)")
+	generateCmd.cobraCommand.
+		Flags().Float64Var(&generateCmd.levelCost, "level-cost", terrace.CostLevel, "Cost for a level access")
+	generateCmd.cobraCommand.
+		Flags().Float64Var(&generateCmd.eventCost, "event-cost", terrace.CostEvent, "Cost for an event access")
+	generateCmd.cobraCommand.
+		Flags().StringVar(&generateCmd.costFile, "cost-file", "", "Level and event costs from terrace calibrate")
+	generateCmd.cobraCommand.
+		Flags().Float64Var(&generateCmd.sizeWeight, "size-weight", 0.01, "Cost for each byte of file size per query with the blended cost model")
 	generateCmd.cobraCommand.
 		Flags().BoolVar(&generateCmd.sizeCost, "size-cost", false, "Size-based cost")
+	generateCmd.cobraCommand.
+		Flags().MarkDeprecated("size-cost", "use --cost=size instead")
 	generateCmd.cobraCommand.
 		Flags().BoolVarP(&generateCmd.verbose, "verbose", "v", false, "Verbose logging")
 }
+
+// readEvents reads newline-delimited JSON events from file,
+// or stdin if file is "-".
+func readEvents(logger *log.Logger, file string) []terrace.Event {
+	var eventsFile []byte
+	var err error
+
+	if file == "-" {
+		logger.Println("Using stdin")
+		// stdin
+		eventsFile, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		eventsFile, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	events := []terrace.Event{}
+	for _, eventBytes := range bytes.Split(eventsFile, []byte("\n")) {
+		e := terrace.Event{}
+		if len(eventBytes) == 0 {
+			continue
+		}
+		err = json.Unmarshal(bytes.TrimSpace(eventBytes), &e)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// readConstraintsFile reads a constraints file.
+func readConstraintsFile(logger *log.Logger, file string) terrace.ConstraintsFile {
+	constraintsFile, err := os.Open(file)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer constraintsFile.Close()
+	f := terrace.ConstraintsFile{}
+	err = json.NewDecoder(constraintsFile).Decode(&f)
+	if err != nil {
+		logger.Fatalf("error reading constraints file: %v", err)
+	}
+	return f
+}
@@ -46,8 +46,13 @@ func (cmd *queryCommand) Run() {
 		logger.Fatal(err)
 	}
 
-	level := &terrace.Level{}
-	err = json.NewDecoder(terraceFile).Decode(level)
+	defer terraceFile.Close()
+	terraceFileInfo, err := terraceFile.Stat()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	level, err := terrace.Open(terraceFile, terraceFileInfo.Size())
 	if err != nil {
 		logger.Fatalf("error reading Terrace file: %v", err)
 	}
@@ -57,13 +62,13 @@ func (cmd *queryCommand) Run() {
 		logger.Fatalf("error parsing query: %v", err)
 	}
 
-	executor := query.NewExecutor(level)
-	queryResult, err := executor.Execute(parsedQuery)
+	executor := terrace.NewExecutor(level)
+	rows, err := executor.Execute(parsedQuery)
 	if err != nil {
 		logger.Fatalf("error executing query: %v", err)
 	}
 
-	for _, row := range queryResult.Rows() {
+	for _, row := range rows {
 		marshaled, _ := json.Marshal(row)
 		fmt.Printf("%s\n", marshaled)
 	}
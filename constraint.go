@@ -0,0 +1,524 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/Preetam/query"
+)
+
+// ConstraintOperator represents a constraint operator.
+type ConstraintOperator string
+
+const (
+	// ConstraintOperatorEquals is an equals operator.
+	ConstraintOperatorEquals ConstraintOperator = "="
+	// ConstraintOperatorNotEquals is a not equals operator.
+	ConstraintOperatorNotEquals ConstraintOperator = "!="
+	// ConstraintOperatorLessThan is a less than operator.
+	ConstraintOperatorLessThan ConstraintOperator = "<"
+	// ConstraintOperatorLessThanOrEqual is a less than or equal operator.
+	ConstraintOperatorLessThanOrEqual ConstraintOperator = "<="
+	// ConstraintOperatorGreaterThan is a greater than operator.
+	ConstraintOperatorGreaterThan ConstraintOperator = ">"
+	// ConstraintOperatorGreaterThanOrEqual is a greater than or equal operator.
+	ConstraintOperatorGreaterThanOrEqual ConstraintOperator = ">="
+	// ConstraintOperatorIn is a set membership operator. The value
+	// of the constraint is a list of values.
+	ConstraintOperatorIn ConstraintOperator = "in"
+	// ConstraintOperatorOr is a disjunction of the constraints in Any.
+	// The column of the constraint is ignored.
+	ConstraintOperatorOr ConstraintOperator = "or"
+	// ConstraintOperatorExists is met by events that have the column.
+	ConstraintOperatorExists ConstraintOperator = "exists"
+	// ConstraintOperatorNotExists is met by events that don't have
+	// the column.
+	ConstraintOperatorNotExists ConstraintOperator = "not exists"
+)
+
+// Constraint represents a constraint for a particular column.
+type Constraint struct {
+	Column   string             `json:"column"`
+	Operator ConstraintOperator `json:"operator"`
+	Value    interface{}        `json:"value"`
+	// Any holds the constraints of an "or" constraint.
+	Any []Constraint `json:"any,omitempty"`
+}
+
+// match describes how many events in a level can meet a constraint.
+type match int
+
+const (
+	// matchNone means no event can meet the constraint.
+	matchNone match = iota
+	// matchSome means some events may meet the constraint.
+	matchSome
+	// matchAll means every event meets the constraint.
+	matchAll
+)
+
+// matchRange returns how many values in r can meet the constraint.
+func (c Constraint) matchRange(r ColumnRange) match {
+	if _, ok := r.(MissingColumnRange); ok {
+		// Events without the column only meet "not exists".
+		return matchIf(c.Operator == ConstraintOperatorNotExists)
+	}
+	switch c.Operator {
+	case ConstraintOperatorExists, ConstraintOperatorNotExists:
+		return c.matchValue(r.MinValue())
+	case ConstraintOperatorEquals:
+		if !r.Contains(c.Value) {
+			return matchNone
+		}
+		if r.Single() {
+			return matchAll
+		}
+	case ConstraintOperatorNotEquals:
+		if !r.Contains(c.Value) {
+			return matchAll
+		}
+		if r.Single() {
+			return matchNone
+		}
+	case ConstraintOperatorIn:
+		for _, v := range c.values() {
+			if r.Contains(v) {
+				if r.Single() {
+					return matchAll
+				}
+				return matchSome
+			}
+		}
+		return matchNone
+	case ConstraintOperatorLessThan, ConstraintOperatorLessThanOrEqual,
+		ConstraintOperatorGreaterThan, ConstraintOperatorGreaterThanOrEqual:
+		// Every value in the range meets the constraint if both
+		// ends do, and none does if neither end does.
+		min := c.matchValue(r.MinValue())
+		max := c.matchValue(r.MaxValue())
+		if min == max {
+			return min
+		}
+	}
+	return matchSome
+}
+
+// matchValue returns whether v meets the constraint.
+func (c Constraint) matchValue(v interface{}) match {
+	switch c.Operator {
+	case ConstraintOperatorExists:
+		return matchAll
+	case ConstraintOperatorNotExists:
+		return matchNone
+	}
+	if c.Operator == ConstraintOperatorIn {
+		m := matchNone
+		for _, value := range c.values() {
+			switch (Constraint{Operator: ConstraintOperatorEquals, Value: value}).matchValue(v) {
+			case matchAll:
+				return matchAll
+			case matchSome:
+				m = matchSome
+			}
+		}
+		return m
+	}
+	cmp, ok := compareValues(v, c.Value)
+	if !ok {
+		return matchSome
+	}
+	switch c.Operator {
+	case ConstraintOperatorEquals:
+		return matchIf(cmp == 0)
+	case ConstraintOperatorNotEquals:
+		return matchIf(cmp != 0)
+	case ConstraintOperatorLessThan:
+		return matchIf(cmp < 0)
+	case ConstraintOperatorLessThanOrEqual:
+		return matchIf(cmp <= 0)
+	case ConstraintOperatorGreaterThan:
+		return matchIf(cmp > 0)
+	case ConstraintOperatorGreaterThanOrEqual:
+		return matchIf(cmp >= 0)
+	}
+	return matchSome
+}
+
+// matchLevel returns how many events in l can meet the constraint,
+// based on the range and fixed values of l.
+func (c Constraint) matchLevel(l *Level) match {
+	if c.Operator == ConstraintOperatorOr {
+		m := matchNone
+		for _, cons := range c.Any {
+			switch cons.matchLevel(l) {
+			case matchAll:
+				return matchAll
+			case matchSome:
+				m = matchSome
+			}
+		}
+		return m
+	}
+	m := matchSome
+	if l.InternalRange != nil && l.Column == c.Column {
+		m = c.matchRange(l.InternalRange)
+	}
+	if v, ok := l.Fixed[c.Column]; ok && m == matchSome {
+		m = c.matchValue(v)
+	}
+	return m
+}
+
+// matchEvents returns how many of the events stored directly in l
+// can meet the constraint. Push stores events that don't have the
+// sublevel column in the parent level, so none of them has it.
+func (c Constraint) matchEvents(l *Level) match {
+	switch c.Operator {
+	case ConstraintOperatorOr:
+		m := matchNone
+		for _, cons := range c.Any {
+			switch cons.matchEvents(l) {
+			case matchAll:
+				return matchAll
+			case matchSome:
+				m = matchSome
+			}
+		}
+		return m
+	case ConstraintOperatorExists, ConstraintOperatorNotExists:
+		if l.SublevelColumn != "" && c.Column == l.SublevelColumn {
+			return matchIf(c.Operator == ConstraintOperatorNotExists)
+		}
+	}
+	return c.matchLevel(l)
+}
+
+// values returns the list of values of an "in" constraint.
+func (c Constraint) values() []interface{} {
+	switch v := c.Value.(type) {
+	case []interface{}:
+		return v
+	case []string:
+		values := make([]interface{}, len(v))
+		for i := range v {
+			values[i] = v[i]
+		}
+		return values
+	case []int:
+		values := make([]interface{}, len(v))
+		for i := range v {
+			values[i] = v[i]
+		}
+		return values
+	case []float64:
+		values := make([]interface{}, len(v))
+		for i := range v {
+			values[i] = v[i]
+		}
+		return values
+	}
+	return nil
+}
+
+// constrains returns whether the constraint depends on column.
+func (c Constraint) constrains(column string) bool {
+	if c.Operator != ConstraintOperatorOr {
+		return c.Column == column
+	}
+	for _, cons := range c.Any {
+		if cons.constrains(column) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchIf(b bool) match {
+	if b {
+		return matchAll
+	}
+	return matchNone
+}
+
+// ConstraintSet is a set of constraints for a number of columns.
+// Constraints are keyed by column, except for "or" constraints,
+// which may be stored under any key. A level meets the set if it
+// meets every constraint.
+type ConstraintSet map[string][]Constraint
+
+// Constrains returns whether any constraint in the set depends
+// on column.
+func (cs ConstraintSet) Constrains(column string) bool {
+	if len(cs[column]) > 0 {
+		return true
+	}
+	for _, constraints := range cs {
+		for _, cons := range constraints {
+			if cons.constrains(column) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FilterConstraints returns a ConstraintSet for the query filters.
+// Filters that can't be represented as constraints are left out, so
+// the set may match more events than the filters. The query parser
+// only has comparison filters joined by AND, so "in" and "or"
+// constraints only prune levels when they come from a constraints
+// file, not from queries.
+func FilterConstraints(filters []query.FilterDesc) ConstraintSet {
+	cs := ConstraintSet{}
+	for _, f := range filters {
+		if c, ok := filterConstraint(f); ok {
+			cs[f.Column] = append(cs[f.Column], c)
+		}
+	}
+	return cs
+}
+
+// WorkloadConstraints returns the workload for a list of queries.
+// Queries with the same constraints share a set, weighted by how
+// often it appears. Queries without constraints are left out.
+func WorkloadConstraints(queries []*query.Query) Workload {
+	workload := Workload{}
+	index := map[string]int{}
+	for _, q := range queries {
+		cs := FilterConstraints(q.Filters)
+		if len(cs) == 0 {
+			continue
+		}
+		key := toJSON(cs)
+		i, ok := index[key]
+		if !ok {
+			i = len(workload)
+			index[key] = i
+			workload = append(workload, WeightedConstraintSet{Constraints: cs})
+		}
+		workload[i].Weight++
+	}
+	// Most frequent sets go first.
+	sort.SliceStable(workload, func(i, j int) bool {
+		return workload[i].Weight > workload[j].Weight
+	})
+	return workload
+}
+
+// filterConstraint returns the constraint for a query filter. It
+// returns false if the filter can't be represented as a constraint.
+func filterConstraint(f query.FilterDesc) (Constraint, bool) {
+	op := ConstraintOperator(f.Operator)
+	switch op {
+	case ConstraintOperatorEquals, ConstraintOperatorNotEquals,
+		ConstraintOperatorLessThan, ConstraintOperatorLessThanOrEqual,
+		ConstraintOperatorGreaterThan, ConstraintOperatorGreaterThanOrEqual:
+	default:
+		return Constraint{}, false
+	}
+	return Constraint{
+		Column:   f.Column,
+		Operator: op,
+		Value:    f.Value,
+	}, true
+}
+
+// WeightedConstraintSet is a ConstraintSet with a weight, such as
+// how often its queries run.
+type WeightedConstraintSet struct {
+	Weight      float64       `json:"weight"`
+	Constraints ConstraintSet `json:"constraints"`
+}
+
+// Workload is a list of weighted constraint sets. It is the format
+// of constraints files, alone or in a ConstraintsFile.
+type Workload []WeightedConstraintSet
+
+// UnmarshalJSON decodes a list of weighted constraint sets. Plain
+// constraint sets in the list have a weight of 1.
+func (w *Workload) UnmarshalJSON(b []byte) error {
+	raw := []json.RawMessage{}
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+	workload := make(Workload, 0, len(raw))
+	for _, r := range raw {
+		fields := map[string]json.RawMessage{}
+		err = json.Unmarshal(r, &fields)
+		if err != nil {
+			return err
+		}
+		wcs := WeightedConstraintSet{Weight: 1}
+		// Constraints of a plain set are lists, so a "constraints"
+		// object means the set is weighted.
+		if bytes.HasPrefix(bytes.TrimSpace(fields["constraints"]), []byte("{")) {
+			err = json.Unmarshal(r, &wcs)
+		} else {
+			err = json.Unmarshal(r, &wcs.Constraints)
+		}
+		if err != nil {
+			return err
+		}
+		if wcs.Weight < 0 {
+			return fmt.Errorf("terrace: invalid constraint set weight %v", wcs.Weight)
+		}
+		workload = append(workload, wcs)
+	}
+	*w = workload
+	return nil
+}
+
+// ConstraintsFile is the format of constraints files with options
+// for generation: an object with the workload in "constraints" and
+// the time buckets of columns in "time_buckets". A file with only a
+// workload list is read as a ConstraintsFile without options.
+type ConstraintsFile struct {
+	Workload Workload `json:"constraints"`
+	// TimeBuckets holds the granularity of timestamp columns, like
+	// Options.TimeBuckets.
+	TimeBuckets map[string]TimeGranularity `json:"time_buckets,omitempty"`
+}
+
+// UnmarshalJSON decodes a constraints file object or a workload list.
+func (f *ConstraintsFile) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		*f = ConstraintsFile{}
+		return json.Unmarshal(b, &f.Workload)
+	}
+	type constraintsFile ConstraintsFile
+	file := constraintsFile{}
+	err := json.Unmarshal(b, &file)
+	if err != nil {
+		return err
+	}
+	for column, granularity := range file.TimeBuckets {
+		if _, ok := granularity.duration(); !ok {
+			return fmt.Errorf("terrace: unknown time granularity %q for column %s", granularity, column)
+		}
+	}
+	*f = ConstraintsFile(file)
+	return nil
+}
+
+// ConstraintSets returns the constraint sets of the workload and
+// their weights, for use with Generate and Options.Weights.
+func (w Workload) ConstraintSets() ([]ConstraintSet, []float64) {
+	sets := make([]ConstraintSet, len(w))
+	weights := make([]float64, len(w))
+	for i, wcs := range w {
+		sets[i] = wcs.Constraints
+		weights[i] = wcs.Weight
+	}
+	return sets, weights
+}
+
+// CheckLevel returns false if the level doesn't meet
+// the constraints in the ConstraintSet.
+func (cs ConstraintSet) CheckLevel(level *Level) bool {
+	if level.InternalRange == nil && len(level.Fixed) == 0 {
+		return true
+	}
+	for _, constraints := range cs {
+		for _, cons := range constraints {
+			if cons.matchLevel(level) == matchNone {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CheckEvents returns false if none of the events stored directly
+// in the level, and not in its sublevels, can meet the constraints
+// in the ConstraintSet.
+func (cs ConstraintSet) CheckEvents(level *Level) bool {
+	for _, constraints := range cs {
+		for _, cons := range constraints {
+			if cons.matchEvents(level) == matchNone {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compareValues compares two event values. Numbers sort before
+// strings. Ints are compared with floats as floats, like query
+// filters do, since the query parser reads every number as a float.
+// It returns false if the values can't be compared.
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case int:
+		switch b := b.(type) {
+		case int:
+			return compareInts(a, b), true
+		case float64:
+			return compareFloats(float64(a), b), true
+		case string:
+			return -1, true
+		}
+	case float64:
+		switch b := b.(type) {
+		case int:
+			return compareFloats(a, float64(b)), true
+		case float64:
+			return compareFloats(a, b), true
+		case string:
+			return -1, true
+		}
+	case string:
+		switch b := b.(type) {
+		case string:
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		case int, float64:
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
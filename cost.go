@@ -1,6 +1,9 @@
 package terrace
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 /**
  * Copyright (C) 2018 Preetam Jinka
@@ -20,33 +23,97 @@ import "encoding/json"
  */
 
 const (
-	// CostLevel is the cost for a level access.
+	// CostLevel is the default cost for a level access.
 	CostLevel = 10
-	// CostEvent is the cost for an event access.
+	// CostEvent is the default cost for an event access.
 	CostEvent = 100
 )
 
+// Cost types for Options.CostType.
+//
+// Deprecated: Use Options.CostModel instead.
 const (
 	CostTypeAccess = iota
 	CostTypeSize
 )
 
-func calculateCost(costType int, level *Level, cs ConstraintSet, eventsScale float64) int {
-	if costType == CostTypeAccess {
-		if !cs.CheckLevel(level) {
-			// Doesn't meet constraints; skipped.
-			return 0
-		}
-		cost := 0
-		for _, sublevel := range level.Sublevels {
-			cost += CostLevel + calculateCost(costType, sublevel, cs, eventsScale)
-		}
-		cost += int(eventsScale * float64(CostEvent*len(level.Events)))
-		return cost
-	} else if costType == CostTypeSize {
-		b, _ := json.Marshal(level)
-		return len(b)
-	} else {
-		panic("terrace: unknown cost type")
+// CostModel estimates the cost of a level for a set of constraints.
+// Generate picks the level with the lowest total cost for the
+// constraint sets.
+type CostModel interface {
+	// Cost returns the cost of level for queries constrained by cs.
+	// The level is built from a sample of the events, and eventsScale
+	// is the number of events per sampled event.
+	Cost(level *Level, cs ConstraintSet, eventsScale float64) float64
+}
+
+// AccessCostModel estimates the cost of reading the levels and
+// events that can meet the constraints.
+type AccessCostModel struct {
+	// LevelCost is the cost for a level access.
+	LevelCost float64 `json:"level_cost"`
+	// EventCost is the cost for an event access.
+	EventCost float64 `json:"event_cost"`
+}
+
+// DefaultAccessCostModel is the default cost model.
+var DefaultAccessCostModel = AccessCostModel{LevelCost: CostLevel, EventCost: CostEvent}
+
+// Cost implements CostModel.
+func (m AccessCostModel) Cost(level *Level, cs ConstraintSet, eventsScale float64) float64 {
+	if !cs.CheckLevel(level) {
+		// Doesn't meet constraints; skipped.
+		return 0
+	}
+	cost := 0.0
+	for _, sublevel := range level.Sublevels {
+		cost += m.LevelCost + m.Cost(sublevel, cs, eventsScale)
+	}
+	if cs.CheckEvents(level) {
+		cost += eventsScale * m.EventCost * float64(len(level.Events))
+	}
+	return cost
+}
+
+// SizeCostModel estimates the cost of a level by its encoded size
+// in bytes. It ignores the constraints.
+type SizeCostModel struct{}
+
+// Cost implements CostModel.
+func (SizeCostModel) Cost(level *Level, cs ConstraintSet, eventsScale float64) float64 {
+	b, _ := json.Marshal(level)
+	return float64(len(b))
+}
+
+// BlendedCostModel weighs the access cost of a level against its
+// size.
+type BlendedCostModel struct {
+	Access AccessCostModel
+	// SizeWeight is the cost of a byte of the estimated file size
+	// for each query.
+	SizeWeight float64
+}
+
+// Cost implements CostModel.
+func (m BlendedCostModel) Cost(level *Level, cs ConstraintSet, eventsScale float64) float64 {
+	size := SizeCostModel{}.Cost(level, cs, eventsScale)
+	return m.Access.Cost(level, cs, eventsScale) + m.SizeWeight*eventsScale*size
+}
+
+// costModel returns the cost model for opts.
+func (opts Options) costModel() (CostModel, error) {
+	if opts.CostModel != nil {
+		return opts.CostModel, nil
 	}
+	switch opts.CostType {
+	case CostTypeAccess:
+		return DefaultAccessCostModel, nil
+	case CostTypeSize:
+		return SizeCostModel{}, nil
+	}
+	return nil, fmt.Errorf("terrace: unknown cost type %d", opts.CostType)
 }
+
+var _ CostModel = AccessCostModel{}
+var _ CostModel = SizeCostModel{}
+var _ CostModel = BlendedCostModel{}
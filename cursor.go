@@ -0,0 +1,192 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import "github.com/Preetam/query"
+
+// NewCursor returns a cursor over the raw events of the level.
+func (l *Level) NewCursor() (query.Cursor, error) {
+	return l.newLevelCursor(nil)
+}
+
+// Prune returns a query.Table over the raw events of the level
+// that skips sublevels which can't contain events meeting cs, and
+// the events stored directly in a level when none of them can meet
+// cs. Events in the remaining levels are returned whether or not
+// they meet cs.
+func (l *Level) Prune(cs ConstraintSet) query.Table {
+	return prunedLevel{level: l, constraints: cs}
+}
+
+type prunedLevel struct {
+	level       *Level
+	constraints ConstraintSet
+}
+
+func (p prunedLevel) NewCursor() (query.Cursor, error) {
+	return p.level.newLevelCursor(p.constraints)
+}
+
+func (l *Level) newLevelCursor(cs ConstraintSet) (*LevelCursor, error) {
+	cur := &LevelCursor{constraints: cs}
+	err := cur.push(l, nil)
+	if err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+// LevelCursor is a cursor over the raw events of a Level. It walks
+// the level tree depth-first and builds each event only when it is
+// reached, so it only holds the events of the levels on the current
+// path in memory. The level itself is never modified.
+type LevelCursor struct {
+	constraints ConstraintSet
+
+	stack []*cursorFrame
+	event Event
+	err   error
+}
+
+// cursorFrame is the state of a level on the cursor's path.
+type cursorFrame struct {
+	level *Level
+	// fixed holds the values shared by every event in the level,
+	// including values fixed by its ancestors.
+	fixed map[string]interface{}
+	// events are the events stored directly in the level.
+	events []Event
+	// empty is the number of events in the level that only
+	// contain fixed values. Trim removes them from Events.
+	empty    int
+	sublevel int
+}
+
+// push adds a frame for l to the cursor's path, unless l
+// doesn't meet the cursor's constraints. The events stored
+// directly in l are skipped if none of them can meet the
+// constraints.
+func (cur *LevelCursor) push(l *Level, parentFixed map[string]interface{}) error {
+	if !cur.constraints.CheckLevel(l) {
+		return nil
+	}
+	f := &cursorFrame{
+		level: l,
+		fixed: levelFixed(l, parentFixed),
+	}
+	if cur.constraints.CheckEvents(l) {
+		events, err := l.ReadEvents()
+		if err != nil {
+			return err
+		}
+		f.events = events
+		f.empty = emptyEvents(l, len(events))
+	}
+	cur.stack = append(cur.stack, f)
+	return nil
+}
+
+// levelFixed returns the values shared by every event in l, given
+// the values shared by every event in its parent.
+func levelFixed(l *Level, parentFixed map[string]interface{}) map[string]interface{} {
+	single := l.InternalRange != nil && l.InternalRange.Single()
+	if len(l.Fixed) == 0 && !single {
+		return parentFixed
+	}
+	fixed := make(map[string]interface{}, len(parentFixed)+len(l.Fixed)+1)
+	for k, v := range parentFixed {
+		fixed[k] = v
+	}
+	for k, v := range l.Fixed {
+		fixed[k] = v
+	}
+	if single {
+		// Push removes single-valued columns from events.
+		fixed[l.Column] = l.InternalRange.MinValue()
+	}
+	return fixed
+}
+
+// emptyEvents returns the number of events stored in l that only
+// contain fixed values, given the number of events in l.Events.
+func emptyEvents(l *Level, numEvents int) int {
+	empty := l.Count - numEvents
+	for _, sublevel := range l.Sublevels {
+		empty -= sublevel.Count
+	}
+	if empty < 0 {
+		empty = 0
+	}
+	return empty
+}
+
+// buildEvent returns a new event with the fixed values and the
+// fields of e. Fields of e take precedence over fixed values.
+func buildEvent(e Event, fixed map[string]interface{}) Event {
+	event := make(Event, len(e)+len(fixed))
+	for k, v := range fixed {
+		event[k] = v
+	}
+	for k, v := range e {
+		event[k] = v
+	}
+	return event
+}
+
+// Row returns the current row.
+func (cur *LevelCursor) Row() query.Row {
+	if cur.event == nil {
+		return nil
+	}
+	return cur.event
+}
+
+// Next advances the cursor to the next row. It returns false
+// when there are no more rows or an error occurred.
+func (cur *LevelCursor) Next() bool {
+	cur.event = nil
+	for len(cur.stack) > 0 && cur.err == nil {
+		f := cur.stack[len(cur.stack)-1]
+		if len(f.events) > 0 {
+			cur.event = buildEvent(f.events[0], f.fixed)
+			f.events = f.events[1:]
+			return true
+		}
+		if f.empty > 0 {
+			cur.event = buildEvent(nil, f.fixed)
+			f.empty--
+			return true
+		}
+		if f.sublevel < len(f.level.Sublevels) {
+			sublevel := f.level.Sublevels[f.sublevel]
+			f.sublevel++
+			cur.err = cur.push(sublevel, f.fixed)
+			continue
+		}
+		cur.stack = cur.stack[:len(cur.stack)-1]
+	}
+	return false
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (cur *LevelCursor) Err() error {
+	return cur.err
+}
+
+var _ query.Cursor = &LevelCursor{}
+var _ query.Table = prunedLevel{}
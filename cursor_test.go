@@ -0,0 +1,250 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/Preetam/query"
+)
+
+func TestLevelCursor(t *testing.T) {
+	events, level := generateTestLevel(t)
+	before := toJSON(level)
+
+	parsedQuery, err := query.Parse("SELECT *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := query.NewExecutor(level).Execute(parsedQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []Event{}
+	for _, row := range result.Rows() {
+		e := Event{}
+		for _, field := range row.Fields() {
+			e[field], _ = row.Get(field)
+		}
+		rows = append(rows, e)
+	}
+	if equal, _ := compareEvents(events, rows); !equal {
+		t.Errorf("expected %d rows, got %d", len(events), len(rows))
+	}
+
+	if after := toJSON(level); after != before {
+		t.Error("level was modified by the cursor")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	_, level := partitionTestEvents(t, "region")
+
+	parsedQuery, err := query.Parse(`SELECT * WHERE region = "us-west-1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := level.Prune(FilterConstraints(parsedQuery.Filters)).NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for cur.Next() {
+		if region, _ := cur.Row().Get("region"); region != "us-west-1" {
+			t.Errorf("expected region us-west-1, got %v", region)
+		}
+		n++
+	}
+	if n != 4 {
+		t.Errorf("expected 4 rows, got %d", n)
+	}
+}
+
+func TestPruneInOr(t *testing.T) {
+	_, level := partitionTestEvents(t, "region", "team")
+
+	tests := []struct {
+		constraints string
+		expected    int
+		match       func(e Event) bool
+	}{
+		{
+			constraints: `{"region": [{"column": "region", "operator": "in", "value": ["us-west-1", "us-east-1"]}]}`,
+			expected:    5,
+			match: func(e Event) bool {
+				return e["region"] == "us-west-1" || e["region"] == "us-east-1"
+			},
+		},
+		{
+			constraints: `{"region": [{"operator": "or", "any": [
+				{"column": "region", "operator": "=", "value": "us-west-1"},
+				{"column": "team", "operator": "=", "value": "CHI"}
+			]}]}`,
+			expected: 5,
+			match: func(e Event) bool {
+				return e["region"] == "us-west-1" || e["team"] == "CHI"
+			},
+		},
+	}
+	for _, test := range tests {
+		cs := ConstraintSet{}
+		err := json.Unmarshal([]byte(test.constraints), &cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur, err := level.Prune(cs).NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for cur.Next() {
+			e := cur.Row().(Event)
+			if !test.match(e) {
+				t.Errorf("%s: unexpected event %v", test.constraints, e)
+			}
+			n++
+		}
+		if n != test.expected {
+			t.Errorf("%s: expected %d rows, got %d", test.constraints, test.expected, n)
+		}
+	}
+}
+
+func TestPruneExists(t *testing.T) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTeam := 0
+	for i, e := range events {
+		if i%3 == 0 {
+			events[i] = e.CloneWithout("team")
+			continue
+		}
+		withTeam++
+	}
+	level := partitionEvents(events, nil, "team")
+
+	for _, op := range []ConstraintOperator{ConstraintOperatorExists, ConstraintOperatorNotExists} {
+		cs := ConstraintSet{"team": {{Column: "team", Operator: op}}}
+		cur, err := level.Prune(cs).NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for cur.Next() {
+			_, ok := cur.Row().(Event)["team"]
+			if ok != (op == ConstraintOperatorExists) {
+				t.Errorf("%s: unexpected event %v", op, cur.Row())
+			}
+			n++
+		}
+		expected := withTeam
+		if op == ConstraintOperatorNotExists {
+			expected = len(events) - withTeam
+		}
+		if n != expected {
+			t.Errorf("%s: expected %d rows, got %d", op, expected, n)
+		}
+	}
+
+	cs := ConstraintSet{"team": {{Column: "team", Operator: ConstraintOperatorExists}}}
+	if cost := DefaultAccessCostModel.Cost(level, cs, 1); cost != float64(CostLevel*len(level.Sublevels)+CostEvent*withTeam) {
+		t.Errorf("expected events without team to be left out of the cost, got %v", cost)
+	}
+}
+
+func TestMissingSublevel(t *testing.T) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCode := 0
+	for i, e := range events {
+		if i%4 != 0 {
+			events[i] = e.CloneWithout("error_code")
+			continue
+		}
+		e["error_code"] = 500 + i%3
+		withCode++
+	}
+	if cs := getColumnSet(events); !cs.contains("error_code") {
+		t.Fatalf("expected error_code to be a candidate column, got %v", cs)
+	}
+
+	level := partitionEvents(events, nil, "error_code")
+
+	var missing *Level
+	for _, sublevel := range level.Sublevels {
+		if _, ok := sublevel.InternalRange.(MissingColumnRange); ok {
+			missing = sublevel
+		}
+	}
+	if missing == nil || missing.Count != len(events)-withCode {
+		t.Fatalf("expected a missing sublevel with %d events, got %v", len(events)-withCode, missing)
+	}
+	if len(level.Events) != 0 {
+		t.Errorf("expected no events in the parent level, got %d", len(level.Events))
+	}
+
+	for _, format := range []string{FormatJSON, FormatBinary} {
+		buf := &bytes.Buffer{}
+		err := Encode(buf, level, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.String() != level.String() {
+			t.Errorf("%s: expected decoded level\n%v\nto match\n%v", format, decoded, level)
+		}
+		if equal, _ := compareEvents(events, decoded.RawEvents()); !equal {
+			t.Errorf("%s: events are not equal", format)
+		}
+	}
+
+	tests := []struct {
+		constraint Constraint
+		expected   int
+	}{
+		{Constraint{Column: "error_code", Operator: ConstraintOperatorExists}, withCode},
+		{Constraint{Column: "error_code", Operator: ConstraintOperatorNotExists}, len(events) - withCode},
+		{Constraint{Column: "error_code", Operator: ConstraintOperatorNotEquals, Value: 0}, withCode},
+	}
+	for _, test := range tests {
+		cs := ConstraintSet{"error_code": {test.constraint}}
+		if cs.CheckLevel(missing) != (test.constraint.Operator == ConstraintOperatorNotExists) {
+			t.Errorf("%s: unexpected CheckLevel result for the missing sublevel", test.constraint.Operator)
+		}
+		cur, err := level.Prune(cs).NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for cur.Next() {
+			n++
+		}
+		if n != test.expected {
+			t.Errorf("%s: expected %d rows, got %d", test.constraint.Operator, test.expected, n)
+		}
+	}
+}
@@ -0,0 +1,718 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+const (
+	// FormatJSON is the JSON Terrace file format.
+	FormatJSON = "json"
+	// FormatBinary is the compact binary Terrace file format.
+	FormatBinary = "binary"
+)
+
+// A binary Terrace file is laid out as follows:
+//
+//	header:  magic, uvarint version
+//	blocks:  the event block of every level with events
+//	footer:  the level tree without events; each level records
+//	         the offset and length of its event block
+//	trailer: uint64 footer offset, magic
+//
+// Readers with an io.ReaderAt only need to read the trailer and
+// footer to get the level tree, and can then read event blocks
+// as they are needed.
+
+// binaryMagic starts and ends every binary Terrace file.
+var binaryMagic = []byte("TRRC")
+
+const binaryVersion = 3
+
+// binaryTrailerSize is the size of the trailer at the end of a
+// binary file.
+const binaryTrailerSize = 8 + 4
+
+// Range type tags.
+const (
+	rangeTagNone = iota
+	rangeTagInt
+	rangeTagFloat
+	rangeTagString
+	rangeTagHash
+	rangeTagPrefix
+	rangeTagMissing
+	rangeTagTime
+)
+
+// Value type tags.
+const (
+	valueTagNull = iota
+	valueTagFalse
+	valueTagTrue
+	valueTagInt
+	valueTagFloat
+	valueTagString
+	// valueTagJSON is used for values without a native
+	// encoding, like objects and arrays.
+	valueTagJSON
+)
+
+var errInvalidBinary = errors.New("terrace: invalid binary file")
+
+// Encode writes level to w using format.
+func Encode(w io.Writer, level *Level, format string) error {
+	switch format {
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(level)
+	case FormatBinary:
+		bw := newBinaryWriter(w)
+		bw.write(binaryMagic)
+		bw.writeUvarint(binaryVersion)
+		blocks := map[*Level]blockRef{}
+		bw.writeBlocks(level, blocks)
+		footerOffset := bw.n
+		bw.writeMetadata(level, blocks)
+		binary.LittleEndian.PutUint64(bw.buf[:8], uint64(footerOffset))
+		bw.write(bw.buf[:8])
+		bw.write(binaryMagic)
+		return bw.flush()
+	}
+	return fmt.Errorf("terrace: unknown format %q", format)
+}
+
+// Decode reads a Level from r. The file format is detected
+// automatically. All events are read into memory; use Open
+// to read events only as they are needed.
+func Decode(r io.Reader) (*Level, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(binaryMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(header, binaryMagic) {
+		return decodeJSON(br)
+	}
+
+	b, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	level, err := Open(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	err = level.load()
+	if err != nil {
+		return nil, err
+	}
+	return level, nil
+}
+
+// Open reads the level tree of a Terrace file of the given size.
+// For binary files only the footer is read, and the events of
+// each level are read from r when they are needed, so r must
+// remain open while the level is in use. JSON files are read
+// into memory.
+func Open(r io.ReaderAt, size int64) (*Level, error) {
+	header := make([]byte, len(binaryMagic))
+	_, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(header, binaryMagic) {
+		return decodeJSON(io.NewSectionReader(r, 0, size))
+	}
+
+	if size < int64(len(binaryMagic)+1+binaryTrailerSize) {
+		return nil, errInvalidBinary
+	}
+	// The file is long enough to hold any version number.
+	header = make([]byte, binary.MaxVarintLen64)
+	_, err = r.ReadAt(header, int64(len(binaryMagic)))
+	if err != nil {
+		return nil, err
+	}
+	d := &binaryReader{r: bytes.NewReader(header)}
+	if version := d.readUvarint(); d.err != nil {
+		return nil, d.err
+	} else if version != binaryVersion {
+		return nil, fmt.Errorf("terrace: unsupported binary version %d", version)
+	}
+
+	trailer := make([]byte, binaryTrailerSize)
+	_, err = r.ReadAt(trailer, size-binaryTrailerSize)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[8:], binaryMagic) {
+		return nil, errInvalidBinary
+	}
+	footerOffset := int64(binary.LittleEndian.Uint64(trailer))
+	if footerOffset < 0 || footerOffset > size-binaryTrailerSize {
+		return nil, errInvalidBinary
+	}
+	footer := make([]byte, size-binaryTrailerSize-footerOffset)
+	_, err = r.ReadAt(footer, footerOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	d = &binaryReader{r: bytes.NewReader(footer)}
+	level := d.readMetadata(r, footerOffset)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return level, nil
+}
+
+func decodeJSON(r io.Reader) (*Level, error) {
+	level := &Level{}
+	err := json.NewDecoder(r).Decode(level)
+	if err != nil {
+		return nil, err
+	}
+	return level, nil
+}
+
+// blockRef is the location of an event block in a binary file.
+type blockRef struct {
+	offset int64
+	length int64
+}
+
+// eventBlock is an event block that hasn't been read yet.
+type eventBlock struct {
+	r io.ReaderAt
+	blockRef
+}
+
+func (b *eventBlock) read() ([]Event, error) {
+	block := make([]byte, b.length)
+	_, err := b.r.ReadAt(block, b.offset)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return decodeEvents(block)
+}
+
+// binaryWriter writes the binary format. The first error
+// encountered is kept and all later writes are skipped.
+type binaryWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	// n is the number of bytes written.
+	n   int64
+	err error
+}
+
+func newBinaryWriter(w io.Writer) *binaryWriter {
+	return &binaryWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *binaryWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+func (w *binaryWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *binaryWriter) writeUvarint(n uint64) {
+	w.write(w.buf[:binary.PutUvarint(w.buf[:], n)])
+}
+
+func (w *binaryWriter) writeVarint(n int64) {
+	w.write(w.buf[:binary.PutVarint(w.buf[:], n)])
+}
+
+func (w *binaryWriter) writeFloat(f float64) {
+	binary.LittleEndian.PutUint64(w.buf[:8], math.Float64bits(f))
+	w.write(w.buf[:8])
+}
+
+func (w *binaryWriter) writeString(s string) {
+	w.writeUvarint(uint64(len(s)))
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.WriteString(s)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *binaryWriter) writeValue(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.write([]byte{valueTagNull})
+	case bool:
+		if v {
+			w.write([]byte{valueTagTrue})
+		} else {
+			w.write([]byte{valueTagFalse})
+		}
+	case int:
+		w.write([]byte{valueTagInt})
+		w.writeVarint(int64(v))
+	case float64:
+		w.write([]byte{valueTagFloat})
+		w.writeFloat(v)
+	case string:
+		w.write([]byte{valueTagString})
+		w.writeString(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return
+		}
+		w.write([]byte{valueTagJSON})
+		w.writeString(string(b))
+	}
+}
+
+func (w *binaryWriter) writeRange(r ColumnRange) {
+	switch r := r.(type) {
+	case IntegerColumnRange:
+		w.write([]byte{rangeTagInt})
+		w.writeVarint(int64(r.Min))
+		w.writeVarint(int64(r.Max))
+	case FloatColumnRange:
+		w.write([]byte{rangeTagFloat})
+		w.writeFloat(r.Min)
+		w.writeFloat(r.Max)
+	case StringColumnRange:
+		w.write([]byte{rangeTagString})
+		w.writeString(r.Min)
+		w.writeString(r.Max)
+	case HashColumnRange:
+		w.write([]byte{rangeTagHash})
+		w.writeVarint(int64(r.Buckets))
+		w.writeVarint(int64(r.Min))
+		w.writeVarint(int64(r.Max))
+	case MissingColumnRange:
+		w.write([]byte{rangeTagMissing})
+	case TimeColumnRange:
+		w.write([]byte{rangeTagTime})
+		w.writeString(string(r.Granularity))
+		w.writeVarint(int64(r.Min))
+		w.writeVarint(int64(r.Max))
+	case PrefixColumnRange:
+		w.write([]byte{rangeTagPrefix})
+		w.writeVarint(int64(r.Length))
+		w.writeString(r.Min)
+		w.writeString(r.Max)
+	default:
+		w.write([]byte{rangeTagNone})
+	}
+}
+
+// writeBlocks writes the event blocks of l and its sublevels,
+// recording their locations in blocks.
+func (w *binaryWriter) writeBlocks(l *Level, blocks map[*Level]blockRef) {
+	events, err := l.ReadEvents()
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	if len(events) > 0 {
+		block, err := encodeEvents(events)
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return
+		}
+		blocks[l] = blockRef{offset: w.n, length: int64(len(block))}
+		w.write(block)
+	}
+	for _, sublevel := range l.Sublevels {
+		w.writeBlocks(sublevel, blocks)
+	}
+}
+
+// writeMetadata writes the level tree without events.
+func (w *binaryWriter) writeMetadata(l *Level, blocks map[*Level]blockRef) {
+	w.writeString(l.Column)
+	w.writeRange(l.InternalRange)
+	w.writeString(l.SublevelColumn)
+
+	fixedKeys := sortedKeys(l.Fixed)
+	w.writeUvarint(uint64(len(fixedKeys)))
+	for _, k := range fixedKeys {
+		w.writeString(k)
+		w.writeValue(l.Fixed[k])
+	}
+
+	w.writeUvarint(uint64(l.Count))
+
+	sumKeys := []string{}
+	for k := range l.Sums {
+		sumKeys = append(sumKeys, k)
+	}
+	sort.Strings(sumKeys)
+	w.writeUvarint(uint64(len(sumKeys)))
+	for _, k := range sumKeys {
+		w.writeString(k)
+		w.writeFloat(l.Sums[k])
+		stats := l.Stats[k]
+		w.writeUvarint(uint64(stats.Count))
+		w.writeFloat(stats.Min)
+		w.writeFloat(stats.Max)
+		w.writeFloat(stats.SumSquares)
+	}
+
+	block := blocks[l]
+	w.writeUvarint(uint64(block.offset))
+	w.writeUvarint(uint64(block.length))
+
+	w.writeUvarint(uint64(len(l.Sublevels)))
+	for _, sublevel := range l.Sublevels {
+		w.writeMetadata(sublevel, blocks)
+	}
+}
+
+// encodeEvents encodes events into a block. Each block starts
+// with a table of the keys used by its events so that events
+// only need to refer to keys by index.
+func encodeEvents(events []Event) ([]byte, error) {
+	keyIndexes := map[string]int{}
+	keys := []string{}
+	for _, e := range events {
+		for k := range e {
+			if _, ok := keyIndexes[k]; !ok {
+				keyIndexes[k] = 0
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keyIndexes[k] = i
+	}
+
+	buf := &bytes.Buffer{}
+	w := newBinaryWriter(buf)
+	w.writeUvarint(uint64(len(keys)))
+	for _, k := range keys {
+		w.writeString(k)
+	}
+	w.writeUvarint(uint64(len(events)))
+	for _, e := range events {
+		w.writeUvarint(uint64(len(e)))
+		for _, k := range sortedKeys(e) {
+			w.writeUvarint(uint64(keyIndexes[k]))
+			w.writeValue(e[k])
+		}
+	}
+	err := w.flush()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// binaryReader reads the binary format. The first error
+// encountered is kept and all later reads return zero values.
+type binaryReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *binaryReader) setErr(err error) {
+	if r.err != nil {
+		return
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+}
+
+func (r *binaryReader) readByte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.r.ReadByte()
+	if err != nil {
+		r.setErr(err)
+	}
+	return b
+}
+
+func (r *binaryReader) readUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.setErr(err)
+	}
+	return n
+}
+
+// readCount reads a count, rejecting values that
+// cannot possibly be valid.
+func (r *binaryReader) readCount() int {
+	n := r.readUvarint()
+	if n > math.MaxInt32 {
+		r.setErr(errInvalidBinary)
+		return 0
+	}
+	return int(n)
+}
+
+// readLength reads the number of bytes or items that follow.
+// Every item takes at least one byte, so lengths larger than
+// the rest of the input are rejected before anything is
+// allocated for them.
+func (r *binaryReader) readLength() int {
+	n := r.readCount()
+	if n > r.r.Len() {
+		r.setErr(errInvalidBinary)
+		return 0
+	}
+	return n
+}
+
+func (r *binaryReader) readVarint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(r.r)
+	if err != nil {
+		r.setErr(err)
+	}
+	return n
+}
+
+func (r *binaryReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > r.r.Len() {
+		r.setErr(errInvalidBinary)
+		return nil
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r.r, b)
+	if err != nil {
+		r.setErr(err)
+		return nil
+	}
+	return b
+}
+
+func (r *binaryReader) readFloat() float64 {
+	b := r.readBytes(8)
+	if b == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+func (r *binaryReader) readString() string {
+	return string(r.readBytes(r.readLength()))
+}
+
+func (r *binaryReader) readValue() interface{} {
+	switch tag := r.readByte(); tag {
+	case valueTagNull:
+		return nil
+	case valueTagFalse:
+		return false
+	case valueTagTrue:
+		return true
+	case valueTagInt:
+		return int(r.readVarint())
+	case valueTagFloat:
+		return r.readFloat()
+	case valueTagString:
+		return r.readString()
+	case valueTagJSON:
+		// Decode numbers like Event.UnmarshalJSON so nested
+		// ints keep their precision.
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(r.readBytes(r.readLength())))
+		dec.UseNumber()
+		err := dec.Decode(&v)
+		if err != nil {
+			r.setErr(err)
+		}
+		return convertNumbers(v)
+	}
+	r.setErr(errInvalidBinary)
+	return nil
+}
+
+func (r *binaryReader) readRange() ColumnRange {
+	switch tag := r.readByte(); tag {
+	case rangeTagNone:
+		return nil
+	case rangeTagInt:
+		return IntegerColumnRange{Min: int(r.readVarint()), Max: int(r.readVarint())}
+	case rangeTagFloat:
+		return FloatColumnRange{Min: r.readFloat(), Max: r.readFloat()}
+	case rangeTagString:
+		return StringColumnRange{Min: r.readString(), Max: r.readString()}
+	case rangeTagHash:
+		buckets := int(r.readVarint())
+		if buckets <= 0 {
+			break
+		}
+		return HashColumnRange{Buckets: buckets, Min: int(r.readVarint()), Max: int(r.readVarint())}
+	case rangeTagMissing:
+		return MissingColumnRange{}
+	case rangeTagTime:
+		granularity := TimeGranularity(r.readString())
+		if _, ok := granularity.duration(); !ok {
+			break
+		}
+		return TimeColumnRange{Granularity: granularity, Min: int(r.readVarint()), Max: int(r.readVarint())}
+	case rangeTagPrefix:
+		return PrefixColumnRange{Length: int(r.readVarint()), Min: r.readString(), Max: r.readString()}
+	}
+	r.setErr(errInvalidBinary)
+	return nil
+}
+
+// readMetadata reads a level tree written by writeMetadata. Event
+// blocks are read from f, and must end before footerOffset.
+func (r *binaryReader) readMetadata(f io.ReaderAt, footerOffset int64) *Level {
+	l := &Level{}
+	l.Column = r.readString()
+	l.InternalRange = r.readRange()
+	if l.InternalRange != nil {
+		l.Range = newJSONColumnRange(l.InternalRange)
+	} else if l.Column != "" {
+		// Levels of a column always have a range.
+		r.setErr(errInvalidBinary)
+	}
+	l.SublevelColumn = r.readString()
+
+	if n := r.readLength(); n > 0 {
+		l.Fixed = map[string]interface{}{}
+		for i := 0; i < n && r.err == nil; i++ {
+			k := r.readString()
+			l.Fixed[k] = r.readValue()
+		}
+	}
+
+	l.Count = r.readCount()
+
+	if n := r.readLength(); n > 0 {
+		l.Sums = map[string]float64{}
+		l.Stats = map[string]FieldStats{}
+		for i := 0; i < n && r.err == nil; i++ {
+			k := r.readString()
+			l.Sums[k] = r.readFloat()
+			stats := FieldStats{
+				Count:      r.readCount(),
+				Min:        r.readFloat(),
+				Max:        r.readFloat(),
+				SumSquares: r.readFloat(),
+			}
+			if stats.Count > 0 {
+				l.Stats[k] = stats
+			}
+		}
+	}
+
+	block := blockRef{
+		offset: int64(r.readUvarint()),
+		length: int64(r.readUvarint()),
+	}
+	if block.offset < 0 || block.length < 0 || block.offset+block.length > footerOffset {
+		r.setErr(errInvalidBinary)
+	}
+	if block.length > 0 {
+		l.block = &eventBlock{r: f, blockRef: block}
+	}
+
+	n := r.readLength()
+	for i := 0; i < n && r.err == nil; i++ {
+		l.Sublevels = append(l.Sublevels, r.readMetadata(f, footerOffset))
+	}
+	if r.err != nil {
+		return nil
+	}
+	return l
+}
+
+// decodeEvents decodes a block written by encodeEvents.
+func decodeEvents(block []byte) ([]Event, error) {
+	r := &binaryReader{r: bytes.NewReader(block)}
+	numKeys := r.readLength()
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = r.readString()
+	}
+	n := r.readLength()
+	var events []Event
+	for i := 0; i < n && r.err == nil; i++ {
+		numFields := r.readLength()
+		e := make(Event, numFields)
+		for j := 0; j < numFields && r.err == nil; j++ {
+			keyIndex := r.readCount()
+			if keyIndex >= len(keys) {
+				return nil, errInvalidBinary
+			}
+			e[keys[keyIndex]] = r.readValue()
+		}
+		events = append(events, e)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return events, nil
+}
@@ -0,0 +1,240 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func generateTestLevel(t *testing.T) ([]Event, *Level) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	constraints := []ConstraintSet{
+		{"region": {{Column: "region", Operator: ConstraintOperatorEquals, Value: "us-east-1"}}},
+		{"team": {{Column: "team", Operator: ConstraintOperatorEquals, Value: "SF"}}},
+	}
+	level, err := Generate(nil, events, constraints, Options{Fast: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events, level
+}
+
+func TestEncodeDecode(t *testing.T) {
+	events, level := generateTestLevel(t)
+
+	jsonBuf := &bytes.Buffer{}
+	err := Encode(jsonBuf, level, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryBuf := &bytes.Buffer{}
+	err = Encode(binaryBuf, level, FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binaryBuf.Len() >= jsonBuf.Len() {
+		t.Errorf("expected binary file (%d bytes) to be smaller than JSON (%d bytes)",
+			binaryBuf.Len(), jsonBuf.Len())
+	}
+
+	for _, buf := range []*bytes.Buffer{jsonBuf, binaryBuf} {
+		decoded, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Count != level.Count || len(decoded.Sublevels) != len(level.Sublevels) {
+			t.Errorf("decoded level doesn't match: count %d, %d sublevels",
+				decoded.Count, len(decoded.Sublevels))
+		}
+		if decoded.String() != level.String() {
+			t.Errorf("expected decoded level\n%v\nto match\n%v", decoded, level)
+		}
+		if equal, _ := compareEvents(events, decoded.RawEvents()); !equal {
+			t.Error("events are not equal")
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	events, level := generateTestLevel(t)
+	buf := &bytes.Buffer{}
+	err := Encode(buf, level, FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := Open(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sublevel := range opened.Sublevels {
+		if sublevel.Events != nil {
+			t.Fatal("expected events to be read lazily")
+		}
+	}
+	if equal, _ := compareEvents(events, opened.RawEvents()); !equal {
+		t.Error("events are not equal")
+	}
+}
+
+func TestDecodeInternalRanges(t *testing.T) {
+	_, level := generateTestLevel(t)
+	for _, format := range []string{FormatJSON, FormatBinary} {
+		buf := &bytes.Buffer{}
+		err := Encode(buf, level, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareInternalRanges(t, format, level, decoded)
+	}
+}
+
+// compareInternalRanges checks that every level of decoded has
+// the same typed range as the matching level of level.
+func compareInternalRanges(t *testing.T, format string, level, decoded *Level) {
+	if decoded.InternalRange != level.InternalRange {
+		t.Errorf("%s: expected range %v, got %v",
+			format, level.InternalRange, decoded.InternalRange)
+	}
+	if len(decoded.Sublevels) != len(level.Sublevels) {
+		t.Errorf("%s: expected %d sublevels, got %d",
+			format, len(level.Sublevels), len(decoded.Sublevels))
+		return
+	}
+	for i := range level.Sublevels {
+		compareInternalRanges(t, format, level.Sublevels[i], decoded.Sublevels[i])
+	}
+}
+
+func TestDecodeTruncatedBinary(t *testing.T) {
+	_, level := generateTestLevel(t)
+	buf := &bytes.Buffer{}
+	err := Encode(buf, level, FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Decode(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	if err == nil {
+		t.Error("expected an error decoding a truncated file")
+	}
+}
+
+func TestDecodeCorruptLength(t *testing.T) {
+	_, level := generateTestLevel(t)
+	buf := &bytes.Buffer{}
+	err := Encode(buf, level, FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	footerOffset := int(binary.LittleEndian.Uint64(b[len(b)-binaryTrailerSize:]))
+	// The first event block follows the header, and the footer
+	// starts with the root level's column name. Both start
+	// with a length.
+	for _, offset := range []int{len(binaryMagic) + 1, footerOffset} {
+		corrupt := append([]byte(nil), b...)
+		binary.PutUvarint(corrupt[offset:], math.MaxInt32)
+		_, err = Decode(bytes.NewReader(corrupt))
+		if err != errInvalidBinary {
+			t.Errorf("offset %d: expected %v, got %v", offset, errInvalidBinary, err)
+		}
+	}
+}
+
+func TestDecodeLevelWithoutRange(t *testing.T) {
+	_, err := Decode(bytes.NewReader([]byte(
+		`{"sublevel_column": "region", "sublevels": [{"column": "region", "count": 1}], "count": 1}`)))
+	if err == nil {
+		t.Error("expected an error decoding a JSON level without a range")
+	}
+
+	level := &Level{
+		SublevelColumn: "region",
+		Sublevels:      []*Level{{Column: "region", Count: 1}},
+		Count:          1,
+	}
+	buf := &bytes.Buffer{}
+	err = Encode(buf, level, FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Decode(bytes.NewReader(buf.Bytes()))
+	if err == nil {
+		t.Error("expected an error decoding a binary level without a range")
+	}
+}
+
+func TestNumberRoundTrip(t *testing.T) {
+	lines := []string{
+		`{"_ts":1451606400000000001,"host":"a","usage":0.1,"count":3}`,
+		`{"_ts":1451606400000000002,"host":"b","usage":2.5e3,"count":-7}`,
+		`{"_ts":1451606400000000003,"host":"b","usage":1.0,"count":9007199254740993}`,
+		`{"_ts":1451606400000000004,"host":"c","meta":{"ts":1451817602000000123,"ratio":0.5,"ids":[9007199254740993]}}`,
+	}
+	events := []Event{}
+	for _, line := range lines {
+		e := Event{}
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if ts, ok := events[0]["_ts"].(int); !ok || ts != 1451606400000000001 {
+		t.Fatalf("expected int _ts, got %T %v", events[0]["_ts"], events[0]["_ts"])
+	}
+
+	level := partitionEvents(events, nil, "host")
+
+	for _, format := range []string{FormatJSON, FormatBinary} {
+		buf := &bytes.Buffer{}
+		err := Encode(buf, level, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, raw := range decoded.RawEvents() {
+			found := false
+			for _, e := range events {
+				// JSON doesn't distinguish integral floats from
+				// ints, so only the values have to match.
+				if reflect.DeepEqual(raw, e) || (format == FormatJSON && toJSON(raw) == toJSON(e)) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s: event %v doesn't match any original event", format, raw)
+			}
+		}
+	}
+}
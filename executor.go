@@ -0,0 +1,600 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Preetam/query"
+)
+
+// Executor executes queries against a Level.
+//
+// Queries without aggregates are run by a query.Executor over the
+// pruned level. The filters are applied before the rows reach it,
+// since query.Executor can't compare numbers with strings.
+//
+// Aggregates are computed from the counts, sums and stats stored in
+// each level when the filters match every event in the level, and by
+// scanning events only where they match partially. GROUP BY columns
+// that are partition columns or fixed values are grouped the same
+// way; other columns are grouped by scanning.
+type Executor struct {
+	level *Level
+}
+
+// NewExecutor returns an Executor for level.
+func NewExecutor(level *Level) *Executor {
+	return &Executor{
+		level: level,
+	}
+}
+
+// Execute executes a query and returns the result rows.
+func (e *Executor) Execute(q *query.Query) ([]query.Row, error) {
+	hasAggregates := false
+	for _, c := range q.Columns {
+		if c.Aggregate != "" {
+			hasAggregates = true
+		}
+	}
+	if !hasAggregates {
+		filters, err := buildFilters(q.Filters)
+		if err != nil {
+			return nil, err
+		}
+		table := filteredTable{
+			table:   e.level.Prune(FilterConstraints(q.Filters)),
+			filters: filters,
+		}
+		unfiltered := *q
+		unfiltered.Filters = nil
+		result, err := query.NewExecutor(table).Execute(&unfiltered)
+		if err != nil {
+			return nil, err
+		}
+		return result.Rows(), nil
+	}
+
+	if len(q.OrderBy) > 0 {
+		return nil, query.ErrUnsupported
+	}
+	agg := &aggregation{
+		groupBy: q.GroupBy,
+		groups:  map[string]*aggregateGroup{},
+		exact:   true,
+	}
+	for _, c := range q.Columns {
+		if c.Aggregate == "" {
+			if !isGroupColumn(q.GroupBy, c.Name) {
+				return nil, query.ErrUnsupported
+			}
+			continue
+		}
+		_, err := newAggregate(c)
+		if err != nil {
+			return nil, err
+		}
+		agg.columns = append(agg.columns, c)
+	}
+	for _, c := range q.GroupBy {
+		if c.Aggregate != "" || c.Name == "*" {
+			return nil, query.ErrUnsupported
+		}
+	}
+	var err error
+	agg.filters, err = buildFilters(q.Filters)
+	if err != nil {
+		return nil, err
+	}
+	constraints := []Constraint{}
+	for _, f := range q.Filters {
+		c, ok := filterConstraint(f)
+		if !ok {
+			// Can't tell which levels match this filter
+			// without looking at events.
+			agg.exact = false
+			continue
+		}
+		constraints = append(constraints, c)
+	}
+
+	if len(agg.groupBy) == 0 {
+		// Aggregates without GROUP BY always have a row.
+		agg.group([]interface{}{})
+	}
+	err = agg.walk(e.level, levelScope{}, constraints)
+	if err != nil {
+		return nil, err
+	}
+	return agg.rows(q.Limit), nil
+}
+
+func isGroupColumn(groupBy []query.ColumnDesc, column string) bool {
+	for _, c := range groupBy {
+		if c.Name == column {
+			return true
+		}
+	}
+	return false
+}
+
+// levelScope holds what is known about every event in a level.
+type levelScope struct {
+	// fixed holds the values shared by every event.
+	fixed map[string]interface{}
+	// columns are the partition columns of the level and its
+	// ancestors, which every event has.
+	columns []string
+}
+
+func (s levelScope) sublevel(l *Level) levelScope {
+	sub := levelScope{
+		fixed:   levelFixed(l, s.fixed),
+		columns: s.columns,
+	}
+	if _, missing := l.InternalRange.(MissingColumnRange); l.InternalRange != nil && !missing {
+		sub.columns = append(s.columns[:len(s.columns):len(s.columns)], l.Column)
+	}
+	return sub
+}
+
+// present returns true if every event has column.
+func (s levelScope) present(column string) bool {
+	if _, ok := s.fixed[column]; ok {
+		return true
+	}
+	for _, c := range s.columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregation computes aggregates over the events of a level tree,
+// optionally grouped by columns.
+type aggregation struct {
+	filters []filter
+	// columns are the aggregate columns.
+	columns []query.ColumnDesc
+	groupBy []query.ColumnDesc
+	groups  map[string]*aggregateGroup
+	// exact is true if every filter has a constraint, so levels
+	// whose constraints all match can be aggregated without
+	// looking at their events.
+	exact bool
+}
+
+// aggregateGroup holds the aggregates for a group.
+type aggregateGroup struct {
+	// values are the values of the GROUP BY columns.
+	values     []interface{}
+	aggregates []*aggregate
+}
+
+// group returns the group for the GROUP BY values, creating
+// it if necessary.
+func (agg *aggregation) group(values []interface{}) *aggregateGroup {
+	key := toJSON(values)
+	g, ok := agg.groups[key]
+	if !ok {
+		g = &aggregateGroup{values: values}
+		for _, c := range agg.columns {
+			a, _ := newAggregate(c)
+			g.aggregates = append(g.aggregates, a)
+		}
+		agg.groups[key] = g
+	}
+	return g
+}
+
+// levelGroup returns the group of every event in a level, or
+// false if the events may be in different groups.
+func (agg *aggregation) levelGroup(scope levelScope) (*aggregateGroup, bool) {
+	values := make([]interface{}, len(agg.groupBy))
+	for i, c := range agg.groupBy {
+		v, ok := scope.fixed[c.Name]
+		if !ok {
+			return nil, false
+		}
+		values[i] = v
+	}
+	return agg.group(values), true
+}
+
+// walk adds the events of l that match the filters. pending are
+// the constraints that not every event of l is known to meet.
+func (agg *aggregation) walk(l *Level, parent levelScope, pending []Constraint) error {
+	remaining := []Constraint{}
+	for _, c := range pending {
+		switch c.matchLevel(l) {
+		case matchNone:
+			return nil
+		case matchSome:
+			remaining = append(remaining, c)
+		}
+	}
+
+	scope := parent.sublevel(l)
+	if len(remaining) == 0 && agg.exact {
+		// Every event in the level matches the filters. If they
+		// also share a group, the level can be added as a whole.
+		if g, ok := agg.levelGroup(scope); ok && g.addLevel(l, scope) {
+			return nil
+		}
+	}
+
+	events, err := l.ReadEvents()
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		agg.addEvent(buildEvent(e, scope.fixed))
+	}
+	for i := emptyEvents(l, len(events)); i > 0; i-- {
+		agg.addEvent(buildEvent(nil, scope.fixed))
+	}
+	for _, sublevel := range l.Sublevels {
+		err = agg.walk(sublevel, scope, remaining)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (agg *aggregation) addEvent(e Event) {
+	for _, f := range agg.filters {
+		if !f.Filter(e) {
+			return
+		}
+	}
+	values := make([]interface{}, len(agg.groupBy))
+	for i, c := range agg.groupBy {
+		values[i] = e[c.Name]
+	}
+	for _, a := range agg.group(values).aggregates {
+		a.add(e)
+	}
+}
+
+// rows returns a row for each group, ordered by the group values.
+// Each row has the GROUP BY columns and the aggregates.
+func (agg *aggregation) rows(limit int) []query.Row {
+	groups := make([]*aggregateGroup, 0, len(agg.groups))
+	for _, g := range agg.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		for k := range groups[i].values {
+			a, b := groups[i].values[k], groups[j].values[k]
+			cmp, ok := compareValues(a, b)
+			if !ok {
+				cmp = strings.Compare(toJSON(a), toJSON(b))
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	if limit > 0 && len(groups) > limit {
+		groups = groups[:limit]
+	}
+
+	rows := []query.Row{}
+	for _, g := range groups {
+		row := Event{}
+		for i, c := range agg.groupBy {
+			row[c.Name] = g.values[i]
+		}
+		for _, a := range g.aggregates {
+			row[a.name] = a.result()
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// addLevel adds every event in l using only its metadata. It
+// returns false, without adding anything, if the metadata isn't
+// enough for every aggregate.
+func (g *aggregateGroup) addLevel(l *Level, scope levelScope) bool {
+	for _, a := range g.aggregates {
+		if !a.fromLevel(l, scope) {
+			return false
+		}
+	}
+	for _, a := range g.aggregates {
+		a.addLevel(l, scope)
+	}
+	return true
+}
+
+// aggregate is the state of an aggregate function.
+type aggregate struct {
+	// name is the result column.
+	name     string
+	function string
+	column   string
+
+	// count is the number of events with the column.
+	count int
+	// stats are the statistics of the numeric values.
+	stats FieldStats
+	sum   float64
+}
+
+func newAggregate(c query.ColumnDesc) (*aggregate, error) {
+	a := &aggregate{
+		name:     fmt.Sprintf("%s(%s)", c.Aggregate, c.Name),
+		function: strings.ToUpper(c.Aggregate),
+		column:   c.Name,
+	}
+	switch a.function {
+	case "COUNT":
+	case "SUM", "AVG", "MIN", "MAX", "STDDEV":
+		if a.column == "*" {
+			return nil, fmt.Errorf("terrace: %s requires a column", a.name)
+		}
+	default:
+		return nil, fmt.Errorf("terrace: unsupported aggregate %s", c.Aggregate)
+	}
+	return a, nil
+}
+
+// add adds an event. COUNT counts events with the column, and
+// the other aggregates only use numeric values.
+func (a *aggregate) add(e Event) {
+	if a.column == "*" {
+		a.count++
+		return
+	}
+	v, ok := e[a.column]
+	if !ok {
+		return
+	}
+	a.count++
+	switch n := v.(type) {
+	case int:
+		a.addStats(float64(n), FieldStats{}.add(float64(n)))
+	case float64:
+		a.addStats(n, FieldStats{}.add(n))
+	}
+}
+
+func (a *aggregate) addStats(sum float64, stats FieldStats) {
+	if stats.Count == 0 {
+		return
+	}
+	if a.stats.Count == 0 || stats.Min < a.stats.Min {
+		a.stats.Min = stats.Min
+	}
+	if a.stats.Count == 0 || stats.Max > a.stats.Max {
+		a.stats.Max = stats.Max
+	}
+	a.stats.Count += stats.Count
+	a.stats.SumSquares += stats.SumSquares
+	a.sum += sum
+}
+
+// fromLevel returns true if the events of l can be added using
+// only the level's metadata.
+func (a *aggregate) fromLevel(l *Level, scope levelScope) bool {
+	if a.function == "COUNT" {
+		return a.column == "*" || scope.present(a.column)
+	}
+	if _, ok := scope.fixed[a.column]; ok {
+		return true
+	}
+	if a.function == "SUM" {
+		return true
+	}
+	// Levels written before stats were kept have sums
+	// without stats.
+	_, hasSum := l.Sums[a.column]
+	_, hasStats := l.Stats[a.column]
+	return hasStats || !hasSum
+}
+
+// addLevel adds the events of l using the level's metadata.
+func (a *aggregate) addLevel(l *Level, scope levelScope) {
+	if a.function == "COUNT" {
+		a.count += l.Count
+		return
+	}
+	if v, ok := scope.fixed[a.column]; ok {
+		// Fixed values are removed from events before
+		// they are added to sublevel sums and stats.
+		var n float64
+		switch v := v.(type) {
+		case int:
+			n = float64(v)
+		case float64:
+			n = v
+		default:
+			return
+		}
+		count := float64(l.Count)
+		a.addStats(n*count, FieldStats{
+			Count:      l.Count,
+			Min:        n,
+			Max:        n,
+			SumSquares: n * n * count,
+		})
+		return
+	}
+	if a.function == "SUM" {
+		a.sum += l.Sums[a.column]
+		return
+	}
+	a.addStats(l.Sums[a.column], l.Stats[a.column])
+}
+
+func (a *aggregate) result() interface{} {
+	n := float64(a.stats.Count)
+	switch a.function {
+	case "COUNT":
+		return a.count
+	case "SUM":
+		return a.sum
+	}
+	if a.stats.Count == 0 {
+		return nil
+	}
+	switch a.function {
+	case "AVG":
+		return a.sum / n
+	case "MIN":
+		return a.stats.Min
+	case "MAX":
+		return a.stats.Max
+	case "STDDEV":
+		// Sample standard deviation.
+		if a.stats.Count < 2 {
+			return nil
+		}
+		variance := (a.stats.SumSquares - a.sum*a.sum/n) / (n - 1)
+		if variance < 0 {
+			// Rounding error
+			variance = 0
+		}
+		return math.Sqrt(variance)
+	}
+	return nil
+}
+
+// filter is a filter on a column, like query.Filter. It compares
+// values with compareValues, so numbers sort before strings. Values
+// that can't be compared only meet "!=".
+type filter struct {
+	column string
+	match  func(v interface{}) bool
+}
+
+// Filter returns true if r has the column and its value meets
+// the filter.
+func (f filter) Filter(r query.Row) bool {
+	v, ok := r.Get(f.column)
+	if !ok {
+		return false
+	}
+	return f.match(v)
+}
+
+// comparisonFilter returns a filter for a comparison operator.
+func comparisonFilter(column, operator string, value interface{}) filter {
+	return filter{
+		column: column,
+		match: func(v interface{}) bool {
+			cmp, ok := compareValues(v, value)
+			if !ok {
+				return operator == "!="
+			}
+			switch operator {
+			case "=":
+				return cmp == 0
+			case "!=":
+				return cmp != 0
+			case "<":
+				return cmp < 0
+			case "<=":
+				return cmp <= 0
+			case ">":
+				return cmp > 0
+			case ">=":
+				return cmp >= 0
+			}
+			return false
+		},
+	}
+}
+
+// buildFilters returns the filters for filter descriptions, with
+// the operators query.Executor supports.
+func buildFilters(filterDescs []query.FilterDesc) ([]filter, error) {
+	filters := []filter{}
+	for _, f := range filterDescs {
+		switch f.Operator {
+		case "=", "!=", "<", "<=", ">", ">=":
+			filters = append(filters, comparisonFilter(f.Column, f.Operator, f.Value))
+		case "matches":
+			str, ok := f.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected string value for matches filter")
+			}
+			r, err := regexp.Compile(str)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, filter{
+				column: f.Column,
+				match: func(v interface{}) bool {
+					s, ok := v.(string)
+					return ok && r.MatchString(s)
+				},
+			})
+		default:
+			return nil, fmt.Errorf("unknown filter %s", f.Operator)
+		}
+	}
+	return filters, nil
+}
+
+// filteredTable is a query.Table whose cursors only return the rows
+// that pass every filter.
+type filteredTable struct {
+	table   query.Table
+	filters []filter
+}
+
+func (t filteredTable) NewCursor() (query.Cursor, error) {
+	cur, err := t.table.NewCursor()
+	if err != nil {
+		return nil, err
+	}
+	return &filteredCursor{Cursor: cur, filters: t.filters}, nil
+}
+
+// filteredCursor is a cursor that skips the rows that don't pass
+// every filter.
+type filteredCursor struct {
+	query.Cursor
+	filters []filter
+}
+
+// Next advances the cursor to the next row that passes the filters.
+func (cur *filteredCursor) Next() bool {
+RowLoop:
+	for cur.Cursor.Next() {
+		for _, f := range cur.filters {
+			if !f.Filter(cur.Row()) {
+				continue RowLoop
+			}
+		}
+		return true
+	}
+	return false
+}
+
+var _ query.Table = filteredTable{}
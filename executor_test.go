@@ -0,0 +1,291 @@
+package terrace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Preetam/query"
+)
+
+// partitionTestEvents returns the test events in a level
+// partitioned by columns.
+func partitionTestEvents(t *testing.T, columns ...string) ([]Event, *Level) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events, partitionEvents(events, nil, columns...)
+}
+
+// partitionEvents returns events in a trimmed level partitioned by
+// columns with columnRanges, or with 16 ranges for each column if
+// columnRanges is nil.
+func partitionEvents(events []Event, columnRanges map[string][]ColumnRange, columns ...string) *Level {
+	if columnRanges == nil {
+		columnRanges = getColumnRangesForColumnSet(columnset(columns), 16, events)
+	}
+	level := &Level{}
+	for _, e := range events {
+		level.Push(e, columns, columnRanges)
+	}
+	level.Trim()
+	return level
+}
+
+// dropEvents removes the events stored in every level below l,
+// keeping their metadata.
+func dropEvents(l *Level) {
+	for _, sublevel := range l.Sublevels {
+		sublevel.Events = nil
+		dropEvents(sublevel)
+	}
+}
+
+func executeQuery(t *testing.T, level *Level, q string) []query.Row {
+	parsedQuery, err := query.Parse(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := NewExecutor(level).Execute(parsedQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestAggregatePushdown(t *testing.T) {
+	events, level := partitionTestEvents(t, "region")
+	expectedCount, expectedSum := 0, 0.0
+	for _, e := range events {
+		if e["region"] == "us-west-1" {
+			expectedCount++
+			expectedSum += float64(e["usage_user"].(int))
+		}
+	}
+
+	// Aggregates over whole partitions shouldn't need events.
+	dropEvents(level)
+	rows := executeQuery(t, level,
+		`SELECT COUNT(region), SUM(usage_user) WHERE region = "us-west-1"`)
+	if len(rows) != 1 {
+		t.Fatalf("expected 1 row, got %d", len(rows))
+	}
+	if count, _ := rows[0].Get("COUNT(region)"); count != expectedCount {
+		t.Errorf("expected count %d, got %v", expectedCount, count)
+	}
+	if sum, _ := rows[0].Get("SUM(usage_user)"); sum != expectedSum {
+		t.Errorf("expected sum %v, got %v", expectedSum, sum)
+	}
+}
+
+func TestCountStar(t *testing.T) {
+	events, level := partitionTestEvents(t, "region")
+	expectedCount := 0
+	for _, e := range events {
+		if e["region"] == "us-west-1" {
+			expectedCount++
+		}
+	}
+
+	// The query parser can't parse COUNT(*), so the query is built
+	// directly. Counts of whole partitions shouldn't need events.
+	dropEvents(level)
+	tests := []struct {
+		filters  []query.FilterDesc
+		expected int
+	}{
+		{nil, len(events)},
+		{[]query.FilterDesc{{Column: "region", Operator: "=", Value: "us-west-1"}}, expectedCount},
+	}
+	for _, test := range tests {
+		q := &query.Query{
+			Columns: []query.ColumnDesc{{Name: "*", Aggregate: "COUNT"}},
+			Filters: test.filters,
+		}
+		rows, err := NewExecutor(level).Execute(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("expected 1 row, got %d", len(rows))
+		}
+		if count, _ := rows[0].Get("COUNT(*)"); count != test.expected {
+			t.Errorf("%v: expected count %d, got %v", test.filters, test.expected, count)
+		}
+	}
+}
+
+func TestAggregateScan(t *testing.T) {
+	events, level := partitionTestEvents(t, "region")
+	expectedCount := 0
+	for _, e := range events {
+		if e["region"] == "us-west-1" && e["team"] == "SF" {
+			expectedCount++
+		}
+	}
+
+	rows := executeQuery(t, level,
+		`SELECT COUNT(team) WHERE region = "us-west-1", team = "SF"`)
+	if count, _ := rows[0].Get("COUNT(team)"); count != expectedCount {
+		t.Errorf("expected count %d, got %v", expectedCount, count)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	events, level := partitionTestEvents(t, "region")
+	expectedCounts := map[string]int{}
+	expectedSums := map[string]float64{}
+	for _, e := range events {
+		expectedCounts[e["region"].(string)]++
+		expectedSums[e["region"].(string)] += float64(e["usage_user"].(int))
+	}
+
+	// Groups on a partition column shouldn't need events.
+	dropEvents(level)
+	rows := executeQuery(t, level, `SELECT region, COUNT(region), SUM(usage_user) GROUP BY region`)
+	if len(rows) != len(expectedCounts) {
+		t.Fatalf("expected %d rows, got %d", len(expectedCounts), len(rows))
+	}
+	for _, row := range rows {
+		region, _ := row.Get("region")
+		if count, _ := row.Get("COUNT(region)"); count != expectedCounts[region.(string)] {
+			t.Errorf("%v: expected count %d, got %v", region, expectedCounts[region.(string)], count)
+		}
+		if sum, _ := row.Get("SUM(usage_user)"); sum != expectedSums[region.(string)] {
+			t.Errorf("%v: expected sum %v, got %v", region, expectedSums[region.(string)], sum)
+		}
+	}
+}
+
+func TestGroupByScan(t *testing.T) {
+	events, level := partitionTestEvents(t, "region")
+	expectedCounts := map[string]int{}
+	for _, e := range events {
+		if e["region"] == "us-west-1" {
+			expectedCounts[e["team"].(string)]++
+		}
+	}
+
+	rows := executeQuery(t, level, `SELECT COUNT(team) WHERE region = "us-west-1" GROUP BY team`)
+	if len(rows) != len(expectedCounts) {
+		t.Fatalf("expected %d rows, got %d", len(expectedCounts), len(rows))
+	}
+	for _, row := range rows {
+		team, _ := row.Get("team")
+		if count, _ := row.Get("COUNT(team)"); count != expectedCounts[team.(string)] {
+			t.Errorf("%v: expected count %d, got %v", team, expectedCounts[team.(string)], count)
+		}
+	}
+}
+
+func TestStatsAggregates(t *testing.T) {
+	events, level := partitionTestEvents(t, "region")
+	values := []float64{}
+	for _, e := range events {
+		if e["region"] != "us-east-1" {
+			values = append(values, float64(e["usage_user"].(int)))
+		}
+	}
+	min, max, sum := values[0], values[0], 0.0
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+		sum += v
+	}
+	avg := sum / float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - avg) * (v - avg)
+	}
+	stddev := math.Sqrt(variance / float64(len(values)-1))
+
+	// Stats are combined across every partition but one.
+	dropEvents(level)
+	rows := executeQuery(t, level, `SELECT MIN(usage_user), MAX(usage_user), `+
+		`AVG(usage_user), STDDEV(usage_user) WHERE region != "us-east-1"`)
+	expected := map[string]float64{
+		"MIN(usage_user)":    min,
+		"MAX(usage_user)":    max,
+		"AVG(usage_user)":    avg,
+		"STDDEV(usage_user)": stddev,
+	}
+	for column, expectedValue := range expected {
+		v, _ := rows[0].Get(column)
+		if f, ok := v.(float64); !ok || math.Abs(f-expectedValue) > 1e-9 {
+			t.Errorf("expected %s = %v, got %v", column, expectedValue, v)
+		}
+	}
+}
+
+func TestTimestampFilters(t *testing.T) {
+	// The query parser reads numbers as floats, so nanosecond
+	// timestamps in filters are rounded to the nearest float, and
+	// events are compared with them as floats.
+	const start = 1451817602000000123
+	events := []Event{}
+	for i := 0; i < 300; i++ {
+		events = append(events, Event{"_ts": start + i*7919*int(time.Millisecond), "n": i % 4})
+	}
+	b := bucketing{strategy: BucketDistinct, buckets: 16, timeBuckets: map[string]TimeGranularity{"_ts": TimeMinute}}
+	level := partitionEvents(events, b.columnRanges(columnset{"_ts"}, events), "_ts")
+	buf := &bytes.Buffer{}
+	err := Encode(buf, level, FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := map[string]func(cmp int) bool{
+		"=":  func(cmp int) bool { return cmp == 0 },
+		"!=": func(cmp int) bool { return cmp != 0 },
+		"<":  func(cmp int) bool { return cmp < 0 },
+		"<=": func(cmp int) bool { return cmp <= 0 },
+		">":  func(cmp int) bool { return cmp > 0 },
+		">=": func(cmp int) bool { return cmp >= 0 },
+	}
+	ts := events[117]["_ts"].(int)
+	for op, match := range matches {
+		expected := 0
+		for _, e := range events {
+			if match(compareFloats(float64(e["_ts"].(int)), float64(ts))) {
+				expected++
+			}
+		}
+		if op == "=" && expected != 1 {
+			t.Fatalf("expected one event with _ts %d, got %d", ts, expected)
+		}
+		filter := fmt.Sprintf("_ts %s %d", op, ts)
+		for _, l := range []*Level{level, decoded} {
+			if rows := executeQuery(t, l, "SELECT * WHERE "+filter); len(rows) != expected {
+				t.Errorf("%s: expected %d rows, got %d", filter, expected, len(rows))
+			}
+			rows := executeQuery(t, l, "SELECT COUNT(_ts) WHERE "+filter)
+			if count, _ := rows[0].Get("COUNT(_ts)"); count != expected {
+				t.Errorf("%s: expected count %d, got %v", filter, expected, count)
+			}
+		}
+	}
+}
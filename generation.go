@@ -23,8 +23,10 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 )
 
 func toJSON(v interface{}) string {
@@ -41,118 +43,518 @@ func fromJSON(s string) interface{} {
 	return val
 }
 
+// SearchStrategy is a strategy to search for the column order
+// of a Level.
+type SearchStrategy string
+
+const (
+	// SearchBeam builds column orders one column at a time and keeps
+	// the cheapest orders at each step. Orders are only extended
+	// while adding a column lowers their cost.
+	SearchBeam SearchStrategy = "beam"
+	// SearchSample evaluates a random sample of the permutations
+	// of the columns.
+	SearchSample SearchStrategy = "sample"
+)
+
 // Options represent different options to use during generation.
 type Options struct {
-	Fast     bool
+	Fast bool
+	// CostModel estimates the cost of a level for a constraint set.
+	// It defaults to DefaultAccessCostModel.
+	CostModel CostModel
+	// CostType selects a built-in cost model if CostModel is nil.
+	//
+	// Deprecated: Use CostModel instead.
 	CostType int
+	// Weights holds the weight of each constraint set, such as how
+	// often its queries run. Generate minimizes the weighted cost of
+	// the constraint sets. Every set has a weight of 1 if Weights is
+	// nil.
+	Weights []float64
+	// Search is the search strategy. It defaults to SearchBeam.
+	Search SearchStrategy
+	// BeamWidth is the number of column orders kept at each step
+	// of SearchBeam. It defaults to 4, or 1 with Fast.
+	BeamWidth int
+	// Parallelism is the number of column orders evaluated at the
+	// same time. It defaults to GOMAXPROCS. The CostModel must be
+	// safe for concurrent use if Parallelism isn't 1. The result
+	// doesn't depend on Parallelism.
+	Parallelism int
+	// Seed seeds the sampling of events and column orders. Generate
+	// returns the same Level for the same events, constraints and
+	// options if Seed is set. A random seed is used if Seed is 0.
+	Seed int64
+	// Buckets is the number of ranges the values of a column are
+	// split into. It defaults to 16.
+	Buckets int
+	// ColumnBuckets overrides Buckets for some columns.
+	ColumnBuckets map[string]int
+	// Bucketing is the strategy to split the values of a column into
+	// ranges. It defaults to BucketDistinct.
+	Bucketing BucketStrategy
+	// AlignBuckets aligns range boundaries to the constraint values,
+	// so that every value in a range meets a constraint or none does.
+	// This can add ranges.
+	AlignBuckets bool
+	// AutoBuckets picks the number of ranges of each constrained
+	// column that isn't in ColumnBuckets by cost.
+	AutoBuckets bool
+	// HighCardinality is the strategy to partition string columns
+	// with too many distinct values for value ranges. It defaults to
+	// HighCardinalityHash.
+	HighCardinality HighCardinalityStrategy
+	// TimeBuckets holds the granularity of timestamp columns, such
+	// as _ts, by column. Their numeric values, in nanoseconds since
+	// the epoch, are split into ranges of whole minutes, hours or
+	// days in UTC instead of value ranges. Adjacent buckets share a
+	// range when there are more of them than Buckets or
+	// ColumnBuckets allow.
+	TimeBuckets map[string]TimeGranularity
 }
 
 // Generate generates a Level.
 func Generate(logger *log.Logger, events []Event, constraints []ConstraintSet, opts Options) (*Level, error) {
-	if opts.CostType == 0 {
-		opts.CostType = CostTypeAccess
+	costModel, err := opts.costModel()
+	if err != nil {
+		return nil, err
 	}
-	maxOrderings := 4000.0
-	if opts.Fast {
-		maxOrderings = 10
+	weights := opts.Weights
+	if weights == nil {
+		weights = make([]float64, len(constraints))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if len(weights) != len(constraints) {
+		return nil, fmt.Errorf("terrace: got %d weights for %d constraint sets", len(weights), len(constraints))
+	}
+	for _, w := range weights {
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("terrace: invalid constraint set weight %v", w)
+		}
 	}
 
-	var bestLevel *Level
-	var bestLevelCost = int(math.MaxInt64)
-	var bestColumnOrder = []string{}
-
-	columnSet := getColumnSet(events)
+	columnSet, highCardinality := getColumnSets(events)
+	switch opts.HighCardinality {
+	case HighCardinalityHash, HighCardinalityPrefix:
+	case "":
+		opts.HighCardinality = HighCardinalityHash
+	case HighCardinalityNone:
+		highCardinality = nil
+	default:
+		return nil, fmt.Errorf("terrace: unknown high cardinality strategy %q", opts.HighCardinality)
+	}
+	if len(highCardinality) > 0 {
+		columnSet = append(columnSet, highCardinality...)
+		sort.Strings(columnSet)
+	}
 	if logger != nil {
 		logger.Printf("Generation: Considering column set: %v", columnSet)
 	}
-	var orderings []columnset
-	if opts.Fast {
-		max := len(columnSet)
-		if max > 5 {
-			max = 5
+	seed := opts.Seed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	g := &generator{
+		logger:      logger,
+		parallelism: parallelism,
+		rand:        rand.New(rand.NewSource(seed)),
+		events:      events,
+		constraints: constraints,
+		weights:     weights,
+		costModel:   costModel,
+	}
+
+	b := bucketing{
+		strategy:                opts.Bucketing,
+		buckets:                 opts.Buckets,
+		columnBuckets:           map[string]int{},
+		highCardinality:         map[string]bool{},
+		highCardinalityStrategy: opts.HighCardinality,
+		timeBuckets:             map[string]TimeGranularity{},
+	}
+	for _, column := range highCardinality {
+		b.highCardinality[column] = true
+	}
+	for column, granularity := range opts.TimeBuckets {
+		if _, ok := granularity.duration(); !ok {
+			return nil, fmt.Errorf("terrace: unknown time granularity %q for column %s", granularity, column)
 		}
-		orderings = columnSet.permutate(max)
-	} else {
-		orderings = columnSet.permutate(0)
+		b.timeBuckets[column] = granularity
+	}
+	switch b.strategy {
+	case BucketDistinct, BucketEquiDepth:
+	case "":
+		b.strategy = BucketDistinct
+	default:
+		return nil, fmt.Errorf("terrace: unknown bucketing strategy %q", opts.Bucketing)
+	}
+	if b.buckets <= 0 {
+		b.buckets = 16
+	}
+	for column, n := range opts.ColumnBuckets {
+		b.columnBuckets[column] = n
 	}
+	if opts.AlignBuckets {
+		b.boundaries = constraintBoundaries(constraints)
+	}
+	if opts.AutoBuckets {
+		g.autoBuckets(columnSet, b)
+	}
+	g.columnRanges = b.columnRanges(columnSet, events)
 	if logger != nil {
-		logger.Printf("Generation: %d total possible orderings", len(orderings))
+		logger.Printf("Generation: Using column ranges %s", toJSON(g.columnRanges))
 	}
-	columnRanges := getColumnRangesForColumnSet(columnSet, 16, events)
+	var bestColumnOrder columnset
+	var bestLevelCost float64
+	switch opts.Search {
+	case SearchBeam, "":
+		width := opts.BeamWidth
+		if width <= 0 {
+			width = 4
+			if opts.Fast {
+				width = 1
+			}
+		}
+		maxDepth := len(columnSet)
+		if opts.Fast && maxDepth > 5 {
+			maxDepth = 5
+		}
+		bestColumnOrder, bestLevelCost = g.beamSearch(columnSet, width, maxDepth)
+	case SearchSample:
+		bestColumnOrder, bestLevelCost = g.sampleSearch(columnSet, opts.Fast)
+	default:
+		return nil, fmt.Errorf("terrace: unknown search strategy %q", opts.Search)
+	}
+
 	if logger != nil {
-		logger.Printf("Generation: Using column ranges %s", toJSON(columnRanges))
+		logger.Printf("Generation: Best column order with cost %g: %v", bestLevelCost, bestColumnOrder)
+		logger.Printf("Generation: Generating final level")
 	}
-	seenOrdering := map[string]bool{}
+	bestLevel := &Level{}
+	for _, e := range events {
+		bestLevel.Push(e, bestColumnOrder, g.columnRanges)
+	}
+	if logger != nil {
+		logger.Printf("Generation: Trimming")
+	}
+	bestLevel.Trim()
+	return bestLevel, nil
+}
 
-ORDERINGS_LOOP:
-	for _, allColumns := range orderings {
-		if rand.Float64() > (maxOrderings / float64(len(orderings))) {
+// generator evaluates column orders for Generate.
+type generator struct {
+	logger      *log.Logger
+	parallelism int
+	// rand is only used by the goroutine running the search.
+	rand         *rand.Rand
+	events       []Event
+	constraints  []ConstraintSet
+	weights      []float64
+	costModel    CostModel
+	columnRanges map[string][]ColumnRange
+}
+
+// cost returns the weighted cost of a level with the column order
+// built from events. eventsScale is the number of events per
+// event in events.
+func (g *generator) cost(columnOrder columnset, events []Event, eventsScale float64) float64 {
+	return g.costWithRanges(columnOrder, g.columnRanges, events, eventsScale)
+}
+
+// costWithRanges is like cost, with the given column ranges.
+func (g *generator) costWithRanges(columnOrder columnset, columnRanges map[string][]ColumnRange,
+	events []Event, eventsScale float64) float64 {
+	level := &Level{}
+	for _, e := range events {
+		level.Push(e, columnOrder, columnRanges)
+	}
+	level.Trim()
+	cost := 0.0
+	for i, cs := range g.constraints {
+		cost += g.weights[i] * g.costModel.Cost(level, cs, eventsScale)
+	}
+	if g.logger != nil {
+		g.logger.Printf("Generation: Cost %g for column order %v", cost, columnOrder)
+	}
+	return cost
+}
+
+// autoBuckets sets the number of ranges of each constrained column
+// that isn't in b.columnBuckets to the count with the lowest cost for
+// a level partitioned by the column alone.
+func (g *generator) autoBuckets(columnSet columnset, b bucketing) {
+	events, eventsScale := g.sample()
+	type candidate struct {
+		column  string
+		buckets int
+		cost    float64
+	}
+	candidates := []candidate{}
+	for _, column := range columnSet {
+		if _, ok := b.columnBuckets[column]; ok || !g.constrained(column) {
+			continue
+		}
+		if _, ok := b.timeBuckets[column]; ok {
+			// Time ranges don't depend on the number of buckets.
 			continue
 		}
-		for i := 1; i <= len(allColumns); i++ {
-			columnOrder := allColumns[:i]
+		for _, n := range autoBucketCounts {
+			candidates = append(candidates, candidate{column: column, buckets: n})
+		}
+	}
+	g.forEach(len(candidates), func(i int) {
+		c := &candidates[i]
+		cb := b
+		cb.columnBuckets = map[string]int{c.column: c.buckets}
+		columnRanges := cb.columnRanges(columnset{c.column}, events)
+		c.cost = g.costWithRanges(columnset{c.column}, columnRanges, events, eventsScale)
+	})
+	best := map[string]candidate{}
+	for _, c := range candidates {
+		// Counts are tried in increasing order, so ties go to
+		// fewer ranges.
+		if b, ok := best[c.column]; !ok || c.cost < b.cost {
+			best[c.column] = c
+		}
+	}
+	for _, column := range columnSet {
+		c, ok := best[column]
+		if !ok {
+			continue
+		}
+		if g.logger != nil {
+			g.logger.Printf("Generation: Using %d buckets for column %s", c.buckets, column)
+		}
+		b.columnBuckets[column] = c.buckets
+	}
+}
 
-			if seenOrdering[strings.Join(columnOrder, "")] {
-				continue
+// forEach calls fn for every index up to n on a pool of
+// g.parallelism goroutines.
+func (g *generator) forEach(n int, fn func(i int)) {
+	workers := g.parallelism
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
 			}
-			seenOrdering[strings.Join(columnOrder, "")] = true
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// constrained returns whether any constraint set depends on column.
+// Orders starting with a column that isn't constrained are ignored.
+func (g *generator) constrained(column string) bool {
+	for _, cs := range g.constraints {
+		if cs.Constrains(column) {
+			return true
+		}
+	}
+	return false
+}
+
+// sample returns a sample of about 1000 events and the number of
+// events per sampled event.
+func (g *generator) sample() ([]Event, float64) {
+	if len(g.events) <= 1000 {
+		return g.events, 1
+	}
+	events := []Event{}
+	for _, e := range g.events {
+		if g.rand.Float64() < 1000/float64(len(g.events)) {
+			events = append(events, e)
+		}
+	}
+	if len(events) == 0 {
+		return g.events, 1
+	}
+	return events, float64(len(g.events)) / float64(len(events))
+}
+
+// beamSearch returns the cheapest column order found with a beam
+// search, and its cost. Every order is evaluated on the same sample
+// of events.
+func (g *generator) beamSearch(columnSet columnset, width, maxDepth int) (columnset, float64) {
+	events, eventsScale := g.sample()
 
-			// Rough filter: ignore orderings that are not constrained by
-			// the first column.
-			skipOrdering := true
-			for _, cs := range constraints {
-				if _, ok := cs[columnOrder[0]]; ok {
-					skipOrdering = false
-					break
+	type candidate struct {
+		columnOrder columnset
+		cost        float64
+	}
+	best := candidate{columnOrder: columnset{}, cost: g.cost(columnset{}, events, eventsScale)}
+	beam := []candidate{best}
+	seen := map[string]bool{}
+	for depth := 0; depth < maxDepth && len(beam) > 0; depth++ {
+		parents := []candidate{}
+		next := []candidate{}
+		for _, parent := range beam {
+			for _, column := range columnSet {
+				if parent.columnOrder.contains(column) {
+					continue
+				}
+				if depth == 0 && !g.constrained(column) {
+					continue
 				}
+				columnOrder := append(append(columnset{}, parent.columnOrder...), column)
+				key := strings.Join(columnOrder, "\x00")
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				parents = append(parents, parent)
+				next = append(next, candidate{columnOrder: columnOrder})
 			}
-			if skipOrdering {
-				continue
+		}
+		g.forEach(len(next), func(i int) {
+			next[i].cost = g.cost(next[i].columnOrder, events, eventsScale)
+		})
+		// Prune prefixes that don't lower the cost of their parent.
+		kept := next[:0]
+		for i, c := range next {
+			if c.cost < parents[i].cost {
+				kept = append(kept, c)
 			}
-			level := &Level{}
+		}
+		next = kept
+		sort.SliceStable(next, func(i, j int) bool {
+			return next[i].cost < next[j].cost
+		})
+		if len(next) > width {
+			next = next[:width]
+		}
+		if len(next) > 0 && next[0].cost < best.cost {
+			best = next[0]
+		}
+		beam = next
+	}
+	return best.columnOrder, best.cost
+}
+
+// sampleSearch returns the cheapest column order found in a random
+// sample of the permutations of the columns, and its cost.
+func (g *generator) sampleSearch(columnSet columnset, fast bool) (columnset, float64) {
+	maxOrderings := 4000.0
+	if fast {
+		maxOrderings = 10
+	}
+
+	var bestLevelCost = math.Inf(1)
+	var bestColumnOrder = columnset{}
+
+	var orderings []columnset
+	if fast {
+		max := len(columnSet)
+		if max > 5 {
+			max = 5
+		}
+		orderings = columnSet.permutate(max)
+	} else {
+		orderings = columnSet.permutate(0)
+	}
+	if g.logger != nil {
+		g.logger.Printf("Generation: %d total possible orderings", len(orderings))
+	}
+	// Pick the orderings and their seeds up front so the result
+	// doesn't depend on the order they are evaluated in.
+	type task struct {
+		allColumns columnset
+		rand       *rand.Rand
+		// prefixes are the evaluated prefixes of allColumns, up to
+		// the first one that doesn't lower the cost.
+		prefixes []columnset
+		costs    []float64
+	}
+	tasks := []*task{}
+	for _, allColumns := range orderings {
+		if g.rand.Float64() > (maxOrderings / float64(len(orderings))) {
+			continue
+		}
+		// Rough filter: ignore orderings that are not constrained by
+		// the first column.
+		if len(allColumns) == 0 || !g.constrained(allColumns[0]) {
+			continue
+		}
+		tasks = append(tasks, &task{
+			allColumns: allColumns,
+			rand:       rand.New(rand.NewSource(g.rand.Int63())),
+		})
+	}
 
-			for _, e := range events {
-				if rand.Float64() > (1000 / float64(len(events))) {
+	g.forEach(len(tasks), func(i int) {
+		t := tasks[i]
+		for j := 1; j <= len(t.allColumns); j++ {
+			columnOrder := t.allColumns[:j]
+			events := []Event{}
+			for _, e := range g.events {
+				if t.rand.Float64() > (1000 / float64(len(g.events))) {
 					continue
 				}
-				level.Push(e, []string(columnOrder), columnRanges)
+				events = append(events, e)
 			}
-
-			level.Trim()
-			cost := 0
-			for _, cs := range constraints {
-				cost += calculateCost(opts.CostType, level, cs, (float64(len(events)) / 1000))
+			cost := g.cost(columnOrder, events, float64(len(g.events))/1000)
+			t.prefixes = append(t.prefixes, columnOrder)
+			t.costs = append(t.costs, cost)
+			if j > 1 && cost >= t.costs[j-2] {
+				break
 			}
-			if logger != nil {
-				logger.Printf("Generation: Cost %d for column order %v", cost, columnOrder)
+		}
+	})
+
+	seenOrdering := map[string]bool{}
+TASKS_LOOP:
+	for _, t := range tasks {
+		for j, columnOrder := range t.prefixes {
+			if seenOrdering[strings.Join(columnOrder, "")] {
+				continue
 			}
-			if cost < bestLevelCost {
-				bestLevel = level
-				bestLevelCost = cost
-				bestColumnOrder = []string(columnOrder)
+			seenOrdering[strings.Join(columnOrder, "")] = true
+			if t.costs[j] < bestLevelCost {
+				bestLevelCost = t.costs[j]
+				bestColumnOrder = columnOrder
 			} else {
-				continue ORDERINGS_LOOP
+				continue TASKS_LOOP
 			}
 		}
 	}
-
-	if logger != nil {
-		logger.Printf("Generation: Best column order with cost %d: %v", bestLevelCost, bestColumnOrder)
-		logger.Printf("Generation: Generating final level")
-	}
-	bestLevel = &Level{}
-	for _, e := range events {
-		bestLevel.Push(e, bestColumnOrder, columnRanges)
-	}
-	if logger != nil {
-		logger.Printf("Generation: Trimming")
-	}
-	bestLevel.Trim()
-	return bestLevel, nil
+	return bestColumnOrder, bestLevelCost
 }
 
 type columnset []string
 
+func (cs columnset) contains(column string) bool {
+	for _, c := range cs {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
 // permutate returns permutations of the columnset using
 // Heap's algorithm (see https://en.wikipedia.org/wiki/Heap%27s_algorithm).
 func (cs columnset) permutate(n int) []columnset {
@@ -183,11 +585,19 @@ func (cs columnset) permutate(n int) []columnset {
 
 // getColumnSet returns a good columnset for the given events.
 func getColumnSet(events []Event) columnset {
-	intColumns := map[string]bool{}
-	stringColumns := map[string]bool{}
+	cs, _ := getColumnSets(events)
+	return cs
+}
+
+// getColumnSets returns the columns that can be partitioned with
+// value ranges, and the string columns that have too many distinct
+// values for value ranges. Columns don't have to be in every event,
+// and can have both numbers and strings.
+func getColumnSets(events []Event) (columnset, columnset) {
 	columnCardinality := map[string]map[string]struct{}{}
 	allColumns := map[string]bool{}
 	ignoredColumns := map[string]bool{}
+	highCardinalityColumns := map[string]bool{}
 	const maxCardinality = 2048
 
 	for _, e := range events {
@@ -195,166 +605,49 @@ func getColumnSet(events []Event) columnset {
 			if ignoredColumns[k] {
 				continue
 			}
+			s, isString := v.(string)
 			switch v.(type) {
-			case string:
-				if intColumns[k] {
-					ignoredColumns[k] = true
-					continue
-				}
-				stringColumns[k] = true
-			case int:
-				if stringColumns[k] {
-					ignoredColumns[k] = true
-					continue
-				}
-				intColumns[k] = true
-				ignoredColumns[k] = true
+			case string, int, float64:
 			default:
 				ignoredColumns[k] = true
 				continue
 			}
 			allColumns[k] = true
 
+			if !isString || highCardinalityColumns[k] {
+				// Numbers are split into ranges, so only the
+				// cardinality of strings matters.
+				continue
+			}
 			_, ok := columnCardinality[k]
 			if !ok {
 				columnCardinality[k] = map[string]struct{}{}
 			}
-			columnCardinality[k][fmt.Sprint(v)] = struct{}{}
+			columnCardinality[k][s] = struct{}{}
 			if len(columnCardinality[k]) > maxCardinality {
-				ignoredColumns[k] = true
-			}
-		}
-	}
-	for _, e := range events {
-		for k := range allColumns {
-			if _, ok := e[k]; !ok {
-				ignoredColumns[k] = true
+				highCardinalityColumns[k] = true
+				delete(columnCardinality, k)
 			}
 		}
 	}
 	cs := columnset{}
+	highCardinality := columnset{}
 	for k := range allColumns {
-		if !ignoredColumns[k] {
+		switch {
+		case ignoredColumns[k]:
+		case highCardinalityColumns[k]:
+			highCardinality = append(highCardinality, k)
+		default:
 			cs = append(cs, k)
 		}
 	}
+	// Sort the columns so the search doesn't depend on map order.
+	sort.Strings(cs)
+	sort.Strings(highCardinality)
 
-	return cs
+	return cs, highCardinality
 }
 
 func getColumnRangesForColumnSet(cs columnset, max int, events []Event) map[string][]ColumnRange {
-	result := map[string][]ColumnRange{}
-	for _, column := range cs {
-		var vals sort.Interface
-		seenInts, seenFloats, seenStrings := map[int]bool{}, map[float64]bool{}, map[string]bool{}
-		switch events[0][column].(type) {
-		case int:
-			vals = sort.IntSlice{}
-		case float64:
-			vals = sort.Float64Slice{}
-		case string:
-			vals = sort.StringSlice{}
-		}
-
-		for _, e := range events {
-			if _, ok := e[column]; !ok {
-				continue
-			}
-			switch e[column].(type) {
-			case int:
-				if seenInts[e[column].(int)] {
-					continue
-				}
-				seenInts[e[column].(int)] = true
-				typedVals := vals.(sort.IntSlice)
-				typedVals = append(typedVals, e[column].(int))
-				vals = typedVals
-			case float64:
-				if seenFloats[e[column].(float64)] {
-					continue
-				}
-				seenFloats[e[column].(float64)] = true
-				typedVals := vals.(sort.Float64Slice)
-				typedVals = append(typedVals, e[column].(float64))
-				vals = typedVals
-			case string:
-				if seenStrings[e[column].(string)] {
-					continue
-				}
-				seenStrings[e[column].(string)] = true
-				typedVals := vals.(sort.StringSlice)
-				typedVals = append(typedVals, e[column].(string))
-				vals = typedVals
-			}
-		}
-
-		sort.Sort(vals)
-
-		switch vals.(type) {
-		case sort.IntSlice:
-			parts := splitIntSlice([]int(vals.(sort.IntSlice)), max)
-			for _, part := range parts {
-				min, max := part[0], part[len(part)-1]
-				result[column] = append(result[column], IntegerColumnRange{Min: min, Max: max})
-			}
-		case sort.Float64Slice:
-			parts := splitFloat64Slice([]float64(vals.(sort.Float64Slice)), max)
-			for _, part := range parts {
-				min, max := part[0], part[len(part)-1]
-				result[column] = append(result[column], FloatColumnRange{Min: min, Max: max})
-			}
-		case sort.StringSlice:
-			parts := splitStringSlice([]string(vals.(sort.StringSlice)), max)
-			for _, part := range parts {
-				min, max := part[0], part[len(part)-1]
-				result[column] = append(result[column], StringColumnRange{Min: min, Max: max})
-			}
-		}
-	}
-	return result
-}
-
-func splitIntSlice(s []int, parts int) [][]int {
-	l := len(s)
-	if l < parts {
-		parts = l
-	}
-	result := [][]int{}
-	for i := 0; i < parts; i++ {
-		result = append(result, s[i*(l/parts):(i+1)*(l/parts)])
-	}
-	if partSize := len(result[0]); partSize*parts != l {
-		result[parts-1] = append(result[parts-1], s[parts*partSize:]...)
-	}
-	return result
-}
-
-func splitFloat64Slice(s []float64, parts int) [][]float64 {
-	l := len(s)
-	if l < parts {
-		parts = l
-	}
-	result := [][]float64{}
-	for i := 0; i < parts; i++ {
-		result = append(result, s[i*(l/parts):(i+1)*(l/parts)])
-	}
-	if partSize := len(result[0]); partSize*parts != l {
-		result[parts-1] = append(result[parts-1], s[parts*partSize:]...)
-	}
-	return result
-}
-
-func splitStringSlice(s []string, parts int) [][]string {
-	l := len(s)
-	if l < parts {
-		parts = l
-	}
-	result := [][]string{}
-	for i := 0; i < parts; i++ {
-		result = append(result, s[i*(l/parts):(i+1)*(l/parts)])
-	}
-	if partSize := len(result[0]); partSize*parts != l {
-		result[parts-1] = append(result[parts-1], s[parts*partSize:]...)
-	}
-	return result
+	return bucketing{strategy: BucketDistinct, buckets: max}.columnRanges(cs, events)
 }
@@ -20,11 +20,15 @@ package terrace
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"reflect"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+
+	"github.com/Preetam/query"
 )
 
 func readEvents(file string) ([]Event, error) {
@@ -99,3 +103,309 @@ func TestLossless(t *testing.T) {
 		}
 	}
 }
+
+func TestNumericColumns(t *testing.T) {
+	events := []Event{
+		{"region": "a", "service_version": 1, "usage": 0.5},
+		{"region": "b", "service_version": 2, "usage": 2},
+		{"region": "b", "service_version": 2, "usage": 1.5},
+	}
+	cs := getColumnSet(events)
+	sort.Strings(cs)
+	expected := columnset{"region", "service_version", "usage"}
+	if !reflect.DeepEqual(cs, expected) {
+		t.Errorf("expected column set %v but got %v", expected, cs)
+	}
+
+	columnRanges := getColumnRangesForColumnSet(cs, 16, events)
+	if _, ok := columnRanges["service_version"][0].(IntegerColumnRange); !ok {
+		t.Errorf("expected int ranges for service_version, got %v", columnRanges["service_version"])
+	}
+	for _, r := range columnRanges["usage"] {
+		if _, ok := r.(FloatColumnRange); !ok {
+			t.Errorf("expected float ranges for usage, got %v", columnRanges["usage"])
+		}
+	}
+
+	level := partitionEvents(events, columnRanges, "usage", "service_version")
+	for _, raw := range level.RawEvents() {
+		found := false
+		for _, e := range events {
+			if reflect.DeepEqual(raw, e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("event %v doesn't match any original event", raw)
+		}
+	}
+}
+
+func TestRangeConstraints(t *testing.T) {
+	cs := ConstraintSet{
+		"n": {{Column: "n", Operator: ConstraintOperatorGreaterThanOrEqual, Value: 10.0}},
+	}
+	tests := []struct {
+		r        ColumnRange
+		expected bool
+	}{
+		{IntegerColumnRange{Min: 0, Max: 9}, false},
+		{IntegerColumnRange{Min: 5, Max: 10}, true},
+		{IntegerColumnRange{Min: 10, Max: 20}, true},
+		{FloatColumnRange{Min: 9.5, Max: 9.9}, false},
+	}
+	for _, test := range tests {
+		if got := cs.CheckLevel(&Level{Column: "n", InternalRange: test.r}); got != test.expected {
+			t.Errorf("expected CheckLevel to return %v for %v, got %v", test.expected, test.r, got)
+		}
+	}
+
+	// A layout partitioned on the constrained column should be cheaper.
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs = ConstraintSet{
+		"usage_user": {{Column: "usage_user", Operator: ConstraintOperatorLessThan, Value: 30.0}},
+	}
+	costs := map[string]float64{}
+	for _, column := range []string{"usage_user", "region"} {
+		costs[column] = DefaultAccessCostModel.Cost(partitionEvents(events, nil, column), cs, 1)
+	}
+	if costs["usage_user"] >= costs["region"] {
+		t.Errorf("expected partitioning by usage_user to be cheaper: %v", costs)
+	}
+}
+
+func TestWorkloadConstraints(t *testing.T) {
+	queries := []*query.Query{}
+	for _, q := range []string{
+		`SELECT * WHERE region = "us-west-1"`,
+		`SELECT COUNT(usage_user) WHERE team = "SF"`,
+		`SELECT * WHERE region = "us-west-1"`,
+		`SELECT *`,
+		`SELECT * WHERE region = "us-west-1"`,
+		`SELECT * WHERE team = "SF"`,
+		`SELECT * WHERE region = "us-west-1"`,
+	} {
+		parsedQuery, err := query.Parse(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, parsedQuery)
+	}
+
+	workload := WorkloadConstraints(queries)
+	region := ConstraintSet{"region": {{Column: "region", Operator: ConstraintOperatorEquals, Value: "us-west-1"}}}
+	team := ConstraintSet{"team": {{Column: "team", Operator: ConstraintOperatorEquals, Value: "SF"}}}
+	expected := Workload{{Weight: 4, Constraints: region}, {Weight: 2, Constraints: team}}
+	if toJSON(workload) != toJSON(expected) {
+		t.Errorf("expected workload %v, got %v", toJSON(expected), toJSON(workload))
+	}
+}
+
+func TestDecodeWorkload(t *testing.T) {
+	input := `[
+		{"weight": 1000, "constraints": {"region": [{"column": "region", "operator": "=", "value": "us-west-1"}]}},
+		{"team": [{"column": "team", "operator": "=", "value": "SF"}]},
+		{"constraints": {"team": [{"column": "team", "operator": "=", "value": "NYC"}]}}
+	]`
+	workload := Workload{}
+	err := json.Unmarshal([]byte(input), &workload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constraints, weights := workload.ConstraintSets()
+	if !reflect.DeepEqual(weights, []float64{1000, 1, 1}) {
+		t.Errorf("unexpected weights %v", weights)
+	}
+	if len(constraints) != 3 || constraints[0]["region"][0].Value != "us-west-1" ||
+		constraints[1]["team"][0].Value != "SF" || constraints[2]["team"][0].Value != "NYC" {
+		t.Errorf("unexpected constraints %v", toJSON(constraints))
+	}
+
+	err = json.Unmarshal([]byte(`[{"weight": -1, "constraints": {}}]`), &workload)
+	if err == nil {
+		t.Error("expected an error for a negative weight")
+	}
+
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Generate(nil, events, constraints, Options{Fast: true, Weights: weights[:1]})
+	if err == nil {
+		t.Error("expected an error for a missing weight")
+	}
+}
+
+// columnCostModel prefers partitioned levels, and levels whose
+// sublevels are partitioned by column most. It counts its calls.
+type columnCostModel struct {
+	column string
+	calls  *int64
+}
+
+func (m columnCostModel) Cost(level *Level, cs ConstraintSet, eventsScale float64) float64 {
+	atomic.AddInt64(m.calls, 1)
+	for _, sublevel := range level.Sublevels {
+		if sublevel.SublevelColumn == m.column {
+			return 0
+		}
+	}
+	if len(level.Sublevels) > 0 {
+		return 1
+	}
+	return 2
+}
+
+func TestCostModels(t *testing.T) {
+	_, level := partitionTestEvents(t, "region")
+	cs := ConstraintSet{"region": {{Column: "region", Operator: ConstraintOperatorEquals, Value: "us-west-1"}}}
+
+	access := DefaultAccessCostModel.Cost(level, cs, 2)
+	size := SizeCostModel{}.Cost(level, cs, 2)
+	blended := BlendedCostModel{Access: DefaultAccessCostModel, SizeWeight: 0.5}.Cost(level, cs, 2)
+	if blended != access+size {
+		t.Errorf("expected blended cost %v, got %v", access+size, blended)
+	}
+	cheap := AccessCostModel{LevelCost: 1, EventCost: 1}.Cost(level, cs, 2)
+	if cheap >= access {
+		t.Errorf("expected lower access costs to give a lower cost, got %v and %v", cheap, access)
+	}
+
+	// There are few enough events and column orders that every
+	// order is evaluated with every event.
+	events := []Event{}
+	for i := 0; i < 120; i++ {
+		events = append(events, Event{
+			"region": fmt.Sprintf("region_%d", i%4),
+			"team":   fmt.Sprintf("team_%d", i%3),
+			"usage":  i,
+		})
+	}
+	cs = ConstraintSet{"region": {{Column: "region", Operator: ConstraintOperatorEquals, Value: "region_1"}}}
+	generated, err := Generate(nil, events, []ConstraintSet{cs}, Options{Seed: 1, Search: SearchBeam})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.SublevelColumn != "region" || generated.Sublevels[0].SublevelColumn != "" {
+		t.Fatalf("expected the access cost model to only partition by region, got\n%v", generated)
+	}
+	calls := int64(0)
+	generated, err = Generate(nil, events, []ConstraintSet{cs}, Options{Seed: 1, Search: SearchBeam, CostModel: columnCostModel{column: "team", calls: &calls}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 {
+		t.Error("expected the cost model to be used")
+	}
+	if generated.SublevelColumn != "region" || generated.Sublevels[0].SublevelColumn != "team" {
+		t.Errorf("expected the cost model to partition by region and team, got\n%v", generated)
+	}
+	if equal, _ := compareEvents(events, generated.RawEvents()); !equal {
+		t.Error("events are not equal")
+	}
+
+	_, err = Generate(nil, events, []ConstraintSet{cs}, Options{CostType: 42})
+	if err == nil {
+		t.Error("expected an error for an unknown cost type")
+	}
+}
+
+func TestBeamSearch(t *testing.T) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	constraints := []ConstraintSet{
+		{"region": {{Column: "region", Operator: ConstraintOperatorEquals, Value: "us-west-1"}}},
+		{"region": {{Column: "region", Operator: ConstraintOperatorEquals, Value: "eu-west-1"}}},
+	}
+	for _, opts := range []Options{{}, {Fast: true}, {BeamWidth: 2}} {
+		level, err := Generate(nil, events, constraints, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level.SublevelColumn != "region" {
+			t.Errorf("%+v: expected level to be partitioned by region, got %q", opts, level.SublevelColumn)
+		}
+		if equal, _ := compareEvents(events, level.RawEvents()); !equal {
+			t.Errorf("%+v: events are not equal", opts)
+		}
+	}
+
+	level, err := Generate(nil, events, constraints, Options{Fast: true, Search: SearchSample})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal, _ := compareEvents(events, level.RawEvents()); !equal {
+		t.Error("events are not equal")
+	}
+	_, err = Generate(nil, events, constraints, Options{Search: "exhaustive"})
+	if err == nil {
+		t.Error("expected an error for an unknown search strategy")
+	}
+}
+
+func TestParallelGenerate(t *testing.T) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	constraints := []ConstraintSet{
+		{"region": {{Column: "region", Operator: ConstraintOperatorEquals, Value: "us-west-1"}}},
+		{"team": {{Column: "team", Operator: ConstraintOperatorEquals, Value: "SF"}}},
+		{"usage_user": {{Column: "usage_user", Operator: ConstraintOperatorLessThan, Value: 30}}},
+	}
+	expected := ""
+	for _, parallelism := range []int{1, 2, 8} {
+		level, err := Generate(nil, events, constraints, Options{Parallelism: parallelism})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == "" {
+			expected = level.String()
+		} else if level.String() != expected {
+			t.Errorf("parallelism %d: expected level\n%v\ngot\n%v", parallelism, expected, level)
+		}
+	}
+}
+
+func TestSeededGenerate(t *testing.T) {
+	events, err := readEvents("./_testdata/simple.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough events to sample.
+	for len(events) < 1100 {
+		events = append(events, events[:10]...)
+	}
+	constraints := []ConstraintSet{
+		{"region": {{Column: "region", Operator: ConstraintOperatorEquals, Value: "us-west-1"}}},
+		{"team": {{Column: "team", Operator: ConstraintOperatorEquals, Value: "SF"}}},
+	}
+	for _, search := range []SearchStrategy{SearchBeam, SearchSample} {
+		expected := ""
+		for i, parallelism := range []int{1, 4} {
+			level, err := Generate(nil, events, constraints, Options{
+				Fast:        true,
+				Search:      search,
+				Parallelism: parallelism,
+				Seed:        42,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				expected = toJSON(level)
+			} else if toJSON(level) != expected {
+				t.Errorf("%s: expected the same level with the same seed", search)
+			}
+		}
+	}
+
+	if !sort.StringsAreSorted(getColumnSet(events)) {
+		t.Error("expected the column set to be sorted")
+	}
+}
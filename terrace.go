@@ -18,8 +18,14 @@ package terrace
  */
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Preetam/query"
 )
@@ -27,6 +33,45 @@ import (
 // Event represents an event.
 type Event map[string]interface{}
 
+// UnmarshalJSON decodes an event from JSON. Integers that fit in an
+// int are decoded as int, and other numbers as float64.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
+	}
+	for k, v := range m {
+		m[k] = convertNumbers(v)
+	}
+	*e = m
+	return nil
+}
+
+// convertNumbers replaces json.Number values in v with ints or
+// float64s.
+func convertNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 0); err == nil {
+			return int(n)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = convertNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = convertNumbers(elem)
+		}
+	}
+	return v
+}
+
 // CloneWithout clones an event without a field.
 func (e Event) CloneWithout(field string) Event {
 	e2 := Event{}
@@ -70,25 +115,109 @@ type Level struct {
 	Fixed          map[string]interface{} `json:"fixed,omitempty"`
 	Count          int                    `json:"count"`
 	Sums           map[string]float64     `json:"sums,omitempty"`
+	Stats          map[string]FieldStats  `json:"stats,omitempty"`
+
+	// block is set for levels opened from a binary file
+	// whose events haven't been read yet.
+	block *eventBlock
+}
+
+// UnmarshalJSON decodes a level from JSON. InternalRange isn't
+// encoded, so it's rebuilt from Range.
+func (l *Level) UnmarshalJSON(b []byte) error {
+	type jsonLevel Level
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode((*jsonLevel)(l))
+	if err != nil {
+		return err
+	}
+	for k, v := range l.Fixed {
+		l.Fixed[k] = convertNumbers(v)
+	}
+	l.Range.Min = convertNumbers(l.Range.Min)
+	l.Range.Max = convertNumbers(l.Range.Max)
+	l.InternalRange, err = l.Range.columnRange()
+	if err != nil {
+		return err
+	}
+	if l.Column != "" && l.InternalRange == nil {
+		return fmt.Errorf("terrace: level of column %s has no range", l.Column)
+	}
+	return nil
+}
+
+// ReadEvents returns the events stored directly in this level.
+// Events of levels returned by Open are read from the file
+// without being kept in memory.
+func (l *Level) ReadEvents() ([]Event, error) {
+	if l.block == nil {
+		return l.Events, nil
+	}
+	return l.block.read()
+}
+
+// load reads the events of this level and all of its sublevels
+// into memory.
+func (l *Level) load() error {
+	if l.block != nil {
+		events, err := l.block.read()
+		if err != nil {
+			return err
+		}
+		l.Events = events
+		l.block = nil
+	}
+	for _, sublevel := range l.Sublevels {
+		err := sublevel.load()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FieldStats are statistics for the numeric values of a field
+// in a level. The sum of the values is kept in Level.Sums.
+type FieldStats struct {
+	Count      int     `json:"count"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	SumSquares float64 `json:"sum_squares"`
+}
+
+// add returns the stats with n added.
+func (s FieldStats) add(n float64) FieldStats {
+	if s.Count == 0 || n < s.Min {
+		s.Min = n
+	}
+	if s.Count == 0 || n > s.Max {
+		s.Max = n
+	}
+	s.Count++
+	s.SumSquares += n * n
+	return s
 }
 
 // Push pushes an event into the level.
 func (l *Level) Push(event Event, sublevels []string, columnRanges map[string][]ColumnRange) {
 	l.Count++
 	for k, v := range event {
-		switch v.(type) {
-		case int, float64:
-			if l.Sums == nil {
-				l.Sums = map[string]float64{}
-			}
-		}
-
-		switch v.(type) {
+		var n float64
+		switch v := v.(type) {
 		case int:
-			l.Sums[k] += float64(v.(int))
+			n = float64(v)
 		case float64:
-			l.Sums[k] += v.(float64)
+			n = v
+		default:
+			continue
+		}
+		if l.Sums == nil {
+			l.Sums = map[string]float64{}
+			l.Stats = map[string]FieldStats{}
 		}
+		l.Sums[k] += n
+		l.Stats[k] = l.Stats[k].add(n)
 	}
 
 	if len(sublevels) == 0 {
@@ -97,54 +226,65 @@ func (l *Level) Push(event Event, sublevels []string, columnRanges map[string][]
 	}
 
 	l.SublevelColumn = sublevels[0]
+	ranges := columnRanges[l.SublevelColumn]
 
 	// Check if sublevel column exists
-	if _, ok := event[l.SublevelColumn]; !ok {
-		// Nope
-		l.Events = append(l.Events, event)
-		return
-	}
-
-	// Create sublevels if we need to
-	if len(l.Sublevels) == 0 {
-		for _, r := range columnRanges[l.SublevelColumn] {
-			sublevel := &Level{Column: l.SublevelColumn, InternalRange: r}
-			switch r.(type) {
-			case IntegerColumnRange:
-				sublevel.Range = JSONColumnRange{
-					Type: "int",
-					Min:  r.(IntegerColumnRange).Min,
-					Max:  r.(IntegerColumnRange).Max,
-				}
-			case FloatColumnRange:
-				sublevel.Range = JSONColumnRange{
-					Type: "float",
-					Min:  r.(FloatColumnRange).Min,
-					Max:  r.(FloatColumnRange).Max,
-				}
-			case StringColumnRange:
-				sublevel.Range = JSONColumnRange{
-					Type: "string",
-					Min:  r.(StringColumnRange).Min,
-					Max:  r.(StringColumnRange).Max,
-				}
+	value, ok := event[l.SublevelColumn]
+	if !ok {
+		// Nope. Use the missing sublevel if there is one.
+		for _, r := range ranges {
+			if _, missing := r.(MissingColumnRange); missing {
+				l.sublevel(r, ranges).Push(event, sublevels[1:], columnRanges)
+				return
 			}
-			l.Sublevels = append(l.Sublevels, sublevel)
 		}
+		l.Events = append(l.Events, event)
+		return
 	}
 
-	for _, sublevel := range l.Sublevels {
-		if sublevel.InternalRange.Contains(event[l.SublevelColumn]) {
-			if sublevel.InternalRange.Single() {
+	for _, r := range ranges {
+		if r.Contains(value) {
+			// Single values are restored from the range, unless
+			// they have a different type, like an int in a float
+			// range.
+			if r.Single() && value == r.MinValue() {
 				event = event.CloneWithout(l.SublevelColumn)
 			}
-			sublevel.Push(event, sublevels[1:], columnRanges)
+			l.sublevel(r, ranges).Push(event, sublevels[1:], columnRanges)
 			return
 		}
 	}
 	panic("couldn't find a sublevel")
 }
 
+// sublevel returns the sublevel of l for the range r, creating it if
+// it doesn't exist yet. Sublevels are only created for ranges that
+// get events, and are kept in the same order as ranges.
+func (l *Level) sublevel(r ColumnRange, ranges []ColumnRange) *Level {
+	i := 0
+	for _, columnRange := range ranges {
+		if columnRange == r {
+			break
+		}
+		if i < len(l.Sublevels) && l.Sublevels[i].InternalRange == columnRange {
+			i++
+		}
+	}
+	if i < len(l.Sublevels) && l.Sublevels[i].InternalRange == r {
+		return l.Sublevels[i]
+	}
+
+	sublevel := &Level{
+		Column:        l.SublevelColumn,
+		Range:         newJSONColumnRange(r),
+		InternalRange: r,
+	}
+	l.Sublevels = append(l.Sublevels, nil)
+	copy(l.Sublevels[i+1:], l.Sublevels[i:])
+	l.Sublevels[i] = sublevel
+	return sublevel
+}
+
 // Trim flattens a level and removes any unnecessary sublevels.
 func (l *Level) Trim() {
 	subLevelsToKeep := []*Level{}
@@ -212,66 +352,144 @@ func (l *Level) string(indent int) string {
 }
 
 // RawEvents returns the raw events represented by this level.
+// It panics if the events of a level returned by Open can't
+// be read.
 func (l *Level) RawEvents() []Event {
-	events := make([]Event, 0, l.Count)
-	events = append(events, l.Events...)
-	for _, subLevel := range l.Sublevels {
-		events = append(events, subLevel.RawEvents()...)
+	cur, err := l.newLevelCursor(nil)
+	if err != nil {
+		panic(err)
 	}
-	for len(events) != l.Count {
-		events = append(events, Event{})
+	events := make([]Event, 0, l.Count)
+	for cur.Next() {
+		events = append(events, cur.event)
 	}
-	for i := range events {
-		for k, v := range l.Fixed {
-			events[i][k] = v
-		}
+	if cur.Err() != nil {
+		panic(cur.Err())
 	}
 	return events
 }
 
-func (l *Level) NewCursor() (query.Cursor, error) {
-	return &LevelCursor{
-		events: l.RawEvents(),
-	}, nil
-}
-
-type LevelCursor struct {
-	events []Event
-}
-
-func (cur *LevelCursor) Row() query.Row {
-	if len(cur.events) > 0 {
-		return cur.events[0]
-	}
-	return nil
-}
-
-func (cur *LevelCursor) Next() bool {
-	if len(cur.events) == 0 {
-		return false
-	}
-	cur.events = cur.events[1:]
-	return len(cur.events) > 0
-}
-
-func (cur *LevelCursor) Err() error {
-	return nil
-}
-
-var _ query.Cursor = &LevelCursor{}
-
 // ColumnRange represents a range of values for a column.
 type ColumnRange interface {
 	Contains(v interface{}) bool
 	// Whether this range represents a single value
 	Single() bool
 	MinValue() interface{}
+	MaxValue() interface{}
 }
 
+// JSONColumnRange is the serialized form of a ColumnRange.
 type JSONColumnRange struct {
 	Type string      `json:"type"`
 	Min  interface{} `json:"min"`
 	Max  interface{} `json:"max"`
+	// Buckets is the number of buckets of a hash range.
+	Buckets int `json:"buckets,omitempty"`
+	// Length is the prefix length of a prefix range.
+	Length int `json:"length,omitempty"`
+	// Granularity is the bucket granularity of a time range.
+	Granularity TimeGranularity `json:"granularity,omitempty"`
+}
+
+// columnRange returns the ColumnRange that r represents, or
+// nil if r is empty.
+func (r JSONColumnRange) columnRange() (ColumnRange, error) {
+	switch r.Type {
+	case "":
+		return nil, nil
+	case "int":
+		min, minOK := jsonInt(r.Min)
+		max, maxOK := jsonInt(r.Max)
+		if minOK && maxOK {
+			return IntegerColumnRange{Min: min, Max: max}, nil
+		}
+	case "float":
+		min, minOK := jsonFloat(r.Min)
+		max, maxOK := jsonFloat(r.Max)
+		if minOK && maxOK {
+			return FloatColumnRange{Min: min, Max: max}, nil
+		}
+	case "string":
+		min, minOK := r.Min.(string)
+		max, maxOK := r.Max.(string)
+		if minOK && maxOK {
+			return StringColumnRange{Min: min, Max: max}, nil
+		}
+	case "hash":
+		min, minOK := jsonInt(r.Min)
+		max, maxOK := jsonInt(r.Max)
+		if minOK && maxOK && r.Buckets > 0 {
+			return HashColumnRange{Buckets: r.Buckets, Min: min, Max: max}, nil
+		}
+	case "missing":
+		return MissingColumnRange{}, nil
+	case "time":
+		min, minOK := jsonInt(r.Min)
+		max, maxOK := jsonInt(r.Max)
+		if _, ok := r.Granularity.duration(); minOK && maxOK && ok {
+			return TimeColumnRange{Granularity: r.Granularity, Min: min, Max: max}, nil
+		}
+	case "prefix":
+		min, minOK := r.Min.(string)
+		max, maxOK := r.Max.(string)
+		if minOK && maxOK && r.Length > 0 {
+			return PrefixColumnRange{Length: r.Length, Min: min, Max: max}, nil
+		}
+	default:
+		return nil, fmt.Errorf("terrace: unknown range type %q", r.Type)
+	}
+	return nil, fmt.Errorf("terrace: invalid %s range [%v, %v]", r.Type, r.Min, r.Max)
+}
+
+// jsonInt returns v as an int if it's an integral number.
+func jsonInt(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int:
+		return v, true
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			return int(v), true
+		}
+	case json.Number:
+		n, err := strconv.ParseInt(string(v), 10, 0)
+		return int(n), err == nil
+	}
+	return 0, false
+}
+
+// jsonFloat returns v as a float64 if it's a number.
+func jsonFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// newJSONColumnRange returns the serialized form of r.
+func newJSONColumnRange(r ColumnRange) JSONColumnRange {
+	switch r := r.(type) {
+	case IntegerColumnRange:
+		return JSONColumnRange{Type: "int", Min: r.Min, Max: r.Max}
+	case FloatColumnRange:
+		return JSONColumnRange{Type: "float", Min: r.Min, Max: r.Max}
+	case StringColumnRange:
+		return JSONColumnRange{Type: "string", Min: r.Min, Max: r.Max}
+	case HashColumnRange:
+		return JSONColumnRange{Type: "hash", Min: r.Min, Max: r.Max, Buckets: r.Buckets}
+	case PrefixColumnRange:
+		return JSONColumnRange{Type: "prefix", Min: r.Min, Max: r.Max, Length: r.Length}
+	case MissingColumnRange:
+		return JSONColumnRange{Type: "missing"}
+	case TimeColumnRange:
+		return JSONColumnRange{Type: "time", Min: r.Min, Max: r.Max, Granularity: r.Granularity}
+	}
+	return JSONColumnRange{}
 }
 
 // IntegerColumnRange is an int column range.
@@ -285,11 +503,18 @@ func (r IntegerColumnRange) MinValue() interface{} {
 	return r.Min
 }
 
+// MaxValue returns the max value in the range (inclusive).
+func (r IntegerColumnRange) MaxValue() interface{} {
+	return r.Max
+}
+
 // Contains returns true if the range may contain v.
 func (r IntegerColumnRange) Contains(v interface{}) bool {
-	n, ok := v.(int)
-	if ok {
+	switch n := v.(type) {
+	case int:
 		return r.Min <= n && n <= r.Max
+	case float64:
+		return float64(r.Min) <= n && n <= float64(r.Max)
 	}
 	return false
 }
@@ -310,11 +535,18 @@ func (r FloatColumnRange) MinValue() interface{} {
 	return r.Min
 }
 
+// MaxValue returns the max value in the range (inclusive).
+func (r FloatColumnRange) MaxValue() interface{} {
+	return r.Max
+}
+
 // Contains returns true if the range may contain v.
 func (r FloatColumnRange) Contains(v interface{}) bool {
-	n, ok := v.(float64)
-	if ok {
+	switch n := v.(type) {
+	case float64:
 		return r.Min <= n && n <= r.Max
+	case int:
+		return r.Min <= float64(n) && float64(n) <= r.Max
 	}
 	return false
 }
@@ -335,6 +567,11 @@ func (r StringColumnRange) MinValue() interface{} {
 	return r.Min
 }
 
+// MaxValue returns the max value in the range (inclusive).
+func (r StringColumnRange) MaxValue() interface{} {
+	return r.Max
+}
+
 // Contains returns true if the range may contain v.
 func (r StringColumnRange) Contains(v interface{}) bool {
 	s, ok := v.(string)
@@ -349,42 +586,218 @@ func (r StringColumnRange) Single() bool {
 	return r.Min == r.Max
 }
 
-// ConstraintOperator represents a constraint operator.
-type ConstraintOperator string
+// HashColumnRange is a range of hash buckets for a string column.
+// It contains the strings that hash to a bucket between Min and Max
+// out of Buckets buckets. It is used for columns with too many
+// distinct values for value ranges.
+type HashColumnRange struct {
+	Buckets int `json:"buckets"`
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+}
+
+// hashBucket returns the hash bucket of s out of buckets buckets.
+func hashBucket(s string, buckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// MinValue returns nil, since hash ranges aren't ordered.
+func (r HashColumnRange) MinValue() interface{} {
+	return nil
+}
+
+// MaxValue returns nil, since hash ranges aren't ordered.
+func (r HashColumnRange) MaxValue() interface{} {
+	return nil
+}
+
+// Contains returns true if the range may contain v.
+func (r HashColumnRange) Contains(v interface{}) bool {
+	s, ok := v.(string)
+	if !ok || r.Buckets <= 0 {
+		return false
+	}
+	bucket := hashBucket(s, r.Buckets)
+	return r.Min <= bucket && bucket <= r.Max
+}
+
+// Single returns false, since a hash bucket can hold any
+// number of values.
+func (r HashColumnRange) Single() bool {
+	return false
+}
+
+func (r HashColumnRange) String() string {
+	return fmt.Sprintf("hash[%d, %d]/%d", r.Min, r.Max, r.Buckets)
+}
+
+// PrefixColumnRange is a range of prefixes for a string column. It
+// contains the strings whose first Length bytes are between Min and
+// Max. It is used for columns with too many distinct values for
+// value ranges.
+type PrefixColumnRange struct {
+	Length int    `json:"length"`
+	Min    string `json:"min"`
+	Max    string `json:"max"`
+}
+
+// prefix returns the first n bytes of s.
+func prefix(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// MinValue returns the min value in the range (inclusive).
+func (r PrefixColumnRange) MinValue() interface{} {
+	return r.Min
+}
+
+// MaxValue returns nil, since strings starting with Max can be
+// arbitrarily large.
+func (r PrefixColumnRange) MaxValue() interface{} {
+	return nil
+}
+
+// Contains returns true if the range may contain v.
+func (r PrefixColumnRange) Contains(v interface{}) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	p := prefix(s, r.Length)
+	return r.Min <= p && p <= r.Max
+}
+
+// Single returns false, since a prefix can start any
+// number of values.
+func (r PrefixColumnRange) Single() bool {
+	return false
+}
+
+func (r PrefixColumnRange) String() string {
+	return fmt.Sprintf("prefix[%q, %q]", r.Min, r.Max)
+}
+
+// MissingColumnRange holds the events that don't have a column.
+// Push puts events without the sublevel column into the missing
+// sublevel if there is one, instead of the parent level.
+type MissingColumnRange struct{}
+
+// MinValue returns nil, since the range has no values.
+func (r MissingColumnRange) MinValue() interface{} {
+	return nil
+}
+
+// MaxValue returns nil, since the range has no values.
+func (r MissingColumnRange) MaxValue() interface{} {
+	return nil
+}
+
+// Contains returns false, since the range has no values.
+func (r MissingColumnRange) Contains(v interface{}) bool {
+	return false
+}
+
+// Single returns false, since the range has no value
+// to restore.
+func (r MissingColumnRange) Single() bool {
+	return false
+}
+
+func (r MissingColumnRange) String() string {
+	return "missing"
+}
+
+// TimeGranularity is the size of the calendar buckets of a
+// TimeColumnRange.
+type TimeGranularity string
 
 const (
-	// ConstraintOperatorEquals is an equals operator.
-	ConstraintOperatorEquals ConstraintOperator = "="
-	// ConstraintOperatorNotEquals is a not equals operator.
-	ConstraintOperatorNotEquals = "!="
+	// TimeMinute buckets timestamps by minute.
+	TimeMinute TimeGranularity = "minute"
+	// TimeHour buckets timestamps by hour.
+	TimeHour TimeGranularity = "hour"
+	// TimeDay buckets timestamps by day in UTC.
+	TimeDay TimeGranularity = "day"
 )
 
-// Constraint represents a constraint for a particular column.
-type Constraint struct {
-	Column   string             `json:"column"`
-	Operator ConstraintOperator `json:"operator"`
-	Value    interface{}        `json:"value"`
+// duration returns the length of a bucket in nanoseconds, or false
+// if g isn't a known granularity. Unix time has no leap seconds, so
+// buckets of a fixed length start at the same time as UTC minutes,
+// hours and days.
+func (g TimeGranularity) duration() (int, bool) {
+	switch g {
+	case TimeMinute:
+		return int(time.Minute), true
+	case TimeHour:
+		return int(time.Hour), true
+	case TimeDay:
+		return int(24 * time.Hour), true
+	}
+	return 0, false
 }
 
-// ConstraintSet is a set of constraints for a number of columns.
-type ConstraintSet map[string][]Constraint
+// bucketStart returns the start of the bucket of granularity g that
+// contains the timestamp ts, in nanoseconds since the epoch.
+func (g TimeGranularity) bucketStart(ts int) int {
+	d, _ := g.duration()
+	offset := ts % d
+	if offset < 0 {
+		offset += d
+	}
+	return ts - offset
+}
 
-// CheckLevel returns false if the level doesn't meet
-// the constraints in the ConstraintSet.
-func (cs ConstraintSet) CheckLevel(level *Level) bool {
-	columnConstraints := cs[level.Column]
-	for _, cons := range columnConstraints {
-		if level.InternalRange.Contains(cons.Value) {
-			if cons.Operator == ConstraintOperatorNotEquals {
-				return false
-			}
-		} else {
-			if cons.Operator == ConstraintOperatorEquals {
-				return false
-			}
-		}
+// TimeColumnRange is a range of calendar buckets of a timestamp
+// column, in nanoseconds since the epoch. It contains the timestamps
+// from Min, the start of a bucket, to Max, the last nanosecond of a
+// bucket.
+type TimeColumnRange struct {
+	Granularity TimeGranularity `json:"granularity"`
+	Min         int             `json:"min"`
+	Max         int             `json:"max"`
+}
+
+// MinValue returns the min value in the range (inclusive).
+func (r TimeColumnRange) MinValue() interface{} {
+	return r.Min
+}
+
+// MaxValue returns the max value in the range (inclusive).
+func (r TimeColumnRange) MaxValue() interface{} {
+	return r.Max
+}
+
+// Contains returns true if the range may contain v.
+func (r TimeColumnRange) Contains(v interface{}) bool {
+	switch n := v.(type) {
+	case int:
+		return r.Min <= n && n <= r.Max
+	case float64:
+		return float64(r.Min) <= n && n <= float64(r.Max)
+	}
+	return false
+}
+
+// Single returns false, since a bucket can hold any number
+// of timestamps.
+func (r TimeColumnRange) Single() bool {
+	return false
+}
+
+// String returns the UTC times the range starts and ends at.
+func (r TimeColumnRange) String() string {
+	layout := "2006-01-02T15:04Z"
+	if r.Granularity == TimeDay {
+		layout = "2006-01-02"
 	}
-	return true
+	start := time.Unix(0, int64(r.Min)).UTC().Format(layout)
+	end := time.Unix(0, int64(r.Max)+1).UTC().Format(layout)
+	return fmt.Sprintf("%s[%s, %s)", r.Granularity, start, end)
 }
 
 var _ query.Table = &Level{}